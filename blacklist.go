@@ -0,0 +1,66 @@
+package goharproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+)
+
+// Blacklisting requests
+
+// Urls answered with a status instead of being sent upstream
+type blacklistEntry struct {
+	pattern *regexp.Regexp
+	status  int
+}
+
+// Answers requests whose url matches pattern with status instead of sending them upstream.
+// Their entries are still recorded. Applies to http requests, and to https when it is intercepted.
+func (proxy *HarProxy) Blacklist(pattern string, status int) error {
+	regex, err := regexp.Compile(pattern)
+	if err != nil {
+		return err
+	}
+	if status < 100 || status > 999 {
+		return fmt.Errorf("Invalid status [%v]", status)
+	}
+	proxy.blacklistLock.Lock()
+	defer proxy.blacklistLock.Unlock()
+	proxy.blacklist = append(proxy.blacklist, blacklistEntry{regex, status})
+	return nil
+}
+
+func (proxy *HarProxy) ClearBlacklist() {
+	proxy.blacklistLock.Lock()
+	defer proxy.blacklistLock.Unlock()
+	proxy.blacklist = nil
+}
+
+// The status of the first blacklist entry matching req's url
+func (proxy *HarProxy) blacklistStatus(req *http.Request) (int, bool) {
+	proxy.blacklistLock.Lock()
+	defer proxy.blacklistLock.Unlock()
+	url := req.URL.String()
+	for _, entry := range proxy.blacklist {
+		if entry.pattern.MatchString(url) {
+			return entry.status, true
+		}
+	}
+	return 0, false
+}
+
+func blacklistedResponse(req *http.Request, status int) *http.Response {
+	return &http.Response{
+		Status		  : fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode	  : status,
+		Proto		  : "HTTP/1.1",
+		ProtoMajor	  : 1,
+		ProtoMinor	  : 1,
+		Header		  : make(http.Header),
+		Body		  : ioutil.NopCloser(bytes.NewReader(nil)),
+		ContentLength : 0,
+		Request		  : req,
+	}
+}
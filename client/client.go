@@ -0,0 +1,293 @@
+// Package client talks to the goharproxy REST API
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+)
+
+// Client of a goharproxy server
+type Client struct {
+	// Url of the server, such as http://localhost:8080
+	BaseUrl string
+
+	// Sent as "Authorization: Bearer [Token]" when set
+	Token string
+
+	// Basic auth credentials, sent when Username is set
+	Username string
+	Password string
+
+	// Used to send requests, http.DefaultClient when nil
+	HttpClient *http.Client
+}
+
+// An error answered by the server
+type Error struct {
+	StatusCode int
+	goharproxy.ProxyServerErr
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("goharproxy: %v %v", err.StatusCode, err.ProxyServerErr.Error)
+}
+
+// A proxy created on the server
+type Proxy struct {
+	Port   int
+	client *Client
+}
+
+// Options of a new proxy, zero values and nil leave the server's defaults.
+// Switches are pointers so false can override a default of true, see Bool.
+type ProxyOptions struct {
+	// Port the proxy listens on, one the server chooses when 0
+	Port                    int
+	// Proxy the proxy sends requests through, such as http://proxy:3128
+	Upstream                string
+	WebSocketMaxMessageSize int
+	WebSocketMaxMessages    int
+	WebSocketMetadataOnly   *bool
+	Http2                   *bool
+	CookieJar               *bool
+	CaptureContent          *bool
+	TTL                     time.Duration
+	IdleTimeout             time.Duration
+	ReapHarDir              string
+	ProxyUsername           string
+	ProxyPassword           string
+	RecordProxyUser         *bool
+	MaxEntries              int
+	MaxBodyBytes            int64
+	EvictionPolicy          string
+	HarFile                 *goharproxy.HarFileOptions
+}
+
+// A pointer to v, for the switches of ProxyOptions
+func Bool(v bool) *bool {
+	return &v
+}
+
+func New(baseUrl string) *Client {
+	return &Client{BaseUrl: strings.TrimSuffix(baseUrl, "/")}
+}
+
+// Creates a proxy with opts, nil for the defaults
+func (client *Client) CreateProxy(opts *ProxyOptions) (*Proxy, error) {
+	path := "/proxy"
+	if opts != nil {
+		if params := opts.params().Encode(); params != "" {
+			path += "?" + params
+		}
+	}
+	var port goharproxy.ProxyServerPort
+	if err := client.do("POST", path, nil, &port); err != nil {
+		return nil, err
+	}
+	return &Proxy{Port: port.Port, client: client}, nil
+}
+
+// The proxy on port, which must exist on the server
+func (client *Client) Proxy(port int) *Proxy {
+	return &Proxy{Port: port, client: client}
+}
+
+func (opts *ProxyOptions) params() url.Values {
+	params := url.Values{}
+	setInt := func(name string, v int64) {
+		if v != 0 {
+			params.Set(name, strconv.FormatInt(v, 10))
+		}
+	}
+	setBool := func(name string, v *bool) {
+		if v != nil {
+			params.Set(name, strconv.FormatBool(*v))
+		}
+	}
+	setString := func(name string, v string) {
+		if v != "" {
+			params.Set(name, v)
+		}
+	}
+	setDuration := func(name string, v time.Duration) {
+		if v != 0 {
+			params.Set(name, v.String())
+		}
+	}
+	setInt("port", int64(opts.Port))
+	setString("upstream", opts.Upstream)
+	setInt("webSocketMaxMessageSize", int64(opts.WebSocketMaxMessageSize))
+	setInt("webSocketMaxMessages", int64(opts.WebSocketMaxMessages))
+	setBool("webSocketMetadataOnly", opts.WebSocketMetadataOnly)
+	setBool("http2", opts.Http2)
+	setBool("cookieJar", opts.CookieJar)
+	setBool("captureContent", opts.CaptureContent)
+	setDuration("ttl", opts.TTL)
+	setDuration("idleTimeout", opts.IdleTimeout)
+	setString("reapHarDir", opts.ReapHarDir)
+	setString("proxyUsername", opts.ProxyUsername)
+	setString("proxyPassword", opts.ProxyPassword)
+	setBool("recordProxyUser", opts.RecordProxyUser)
+	setInt("maxEntries", int64(opts.MaxEntries))
+	setInt("maxBodyBytes", opts.MaxBodyBytes)
+	setString("evictionPolicy", opts.EvictionPolicy)
+	if harFile := opts.HarFile; harFile != nil {
+		setString("harDir", harFile.Dir)
+		setString("harFormat", harFile.Format)
+		setInt("harMaxEntries", int64(harFile.MaxEntries))
+		setInt("harMaxBytes", harFile.MaxBytes)
+		setDuration("harMaxAge", harFile.MaxAge)
+		// Sent either way, as the options describe the whole file
+		setBool("harGzip", &harFile.Gzip)
+	}
+	return params
+}
+
+// Url to send requests through the proxy with, such as with http.ProxyURL
+func (proxy *Proxy) Url() (*url.URL, error) {
+	base, err := url.Parse(proxy.client.BaseUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort(base.Hostname(), strconv.Itoa(proxy.Port))}, nil
+}
+
+// Returns the proxy's HAR and clears its entries
+func (proxy *Proxy) GetHar() (*goharproxy.Har, error) {
+	har := new(goharproxy.Har)
+	if err := proxy.client.do("PUT", proxy.path("/har"), nil, har); err != nil {
+		return nil, err
+	}
+	return har, nil
+}
+
+// What the server reports about the proxy, its settings included
+func (proxy *Proxy) Info() (*goharproxy.ProxyInfo, error) {
+	info := new(goharproxy.ProxyInfo)
+	if err := proxy.client.do("GET", proxy.path(""), nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Starts a new page which the entries of the requests that follow refer to, named by the server when id is empty
+func (proxy *Proxy) NewPage(id string, title string) error {
+	return proxy.NewPageWithCustom(id, title, nil)
+}
+
+// Starts a new page as NewPage does, with custom fields named with a leading "_"
+func (proxy *Proxy) NewPageWithCustom(id string, title string, custom map[string]interface{}) error {
+	params := url.Values{}
+	if id != "" {
+		params.Set("pageRef", id)
+	}
+	if title != "" {
+		params.Set("pageTitle", title)
+	}
+	if len(custom) > 0 {
+		data, err := json.Marshal(custom)
+		if err != nil {
+			return err
+		}
+		params.Set("pageCustom", string(data))
+	}
+	return proxy.client.do("PUT", proxy.path("/har/pageRef?" + params.Encode()), nil, nil)
+}
+
+// Remaps hosts, requests to each Host are sent to its NewHost
+func (proxy *Proxy) SetHosts(hosts []goharproxy.ProxyHosts) error {
+	return proxy.client.do("POST", proxy.path("/hosts"), hosts, nil)
+}
+
+// Answers requests whose url matches the regular expression pattern with status instead of sending them upstream
+func (proxy *Proxy) Blacklist(pattern string, status int) error {
+	params := url.Values{"regex": {pattern}, "status": {strconv.Itoa(status)}}
+	return proxy.client.do("PUT", proxy.path("/blacklist?" + params.Encode()), nil, nil)
+}
+
+func (proxy *Proxy) ClearBlacklist() error {
+	return proxy.client.do("DELETE", proxy.path("/blacklist"), nil, nil)
+}
+
+// Answers requests matching rule with its response instead of sending them upstream
+func (proxy *Proxy) AddMock(rule goharproxy.MockRule) error {
+	return proxy.client.do("POST", proxy.path("/mocks"), rule, nil)
+}
+
+func (proxy *Proxy) ClearMocks() error {
+	return proxy.client.do("DELETE", proxy.path("/mocks"), nil, nil)
+}
+
+// Waits until the proxy had no traffic for quietPeriod, failing with a 408 Error after timeout
+func (proxy *Proxy) Wait(quietPeriod time.Duration, timeout time.Duration) error {
+	params := url.Values{"quietPeriod": {quietPeriod.String()}, "timeout": {timeout.String()}}
+	return proxy.client.do("PUT", proxy.path("/wait?" + params.Encode()), nil, nil)
+}
+
+// Stops the proxy and removes it from the server
+func (proxy *Proxy) Delete() error {
+	return proxy.client.do("DELETE", proxy.path(""), nil, nil)
+}
+
+func (proxy *Proxy) path(path string) string {
+	return "/proxy/" + strconv.Itoa(proxy.Port) + path
+}
+
+// Sends body as json and decodes the response into result, unless either is nil
+func (client *Client) do(method string, path string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, client.BaseUrl + path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Token != "" {
+		req.Header.Set("Authorization", "Bearer " + client.Token)
+	} else if client.Username != "" {
+		req.SetBasicAuth(client.Username, client.Password)
+	}
+
+	httpClient := client.HttpClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		serverErr := &Error{StatusCode: resp.StatusCode}
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, &serverErr.ProxyServerErr) != nil || serverErr.ProxyServerErr.Error == "" {
+			serverErr.ProxyServerErr.Error = strings.TrimSpace(string(data))
+		}
+		return serverErr
+	}
+	if result == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Hellspam/goharproxy"
+)
+
+// Starts a server with config, returning a client of it with its token
+func newTestServer(t *testing.T, config goharproxy.ProxyServerConfig) *Client {
+	proxyServer, err := goharproxy.NewServer(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(proxyServer)
+	t.Cleanup(s.Close)
+	client := New(s.URL)
+	client.Token = config.Token
+	return client
+}
+
+// Creates a proxy with opts sending requests for upstream.test to a server answering with the path it was asked for
+func newTestProxy(t *testing.T, client *Client, opts *ProxyOptions) *Proxy {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	t.Cleanup(upstream.Close)
+	proxy, err := client.CreateProxy(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		proxy.Delete()
+	})
+	if err := proxy.SetHosts([]goharproxy.ProxyHosts{{Host: "upstream.test", NewHost: upstream.Listener.Addr().String()}}); err != nil {
+		t.Fatal(err)
+	}
+	return proxy
+}
+
+// Gets path of upstream.test through proxy, returning the status
+func getThrough(t *testing.T, proxy *Proxy, path string) int {
+	proxyUrl, err := proxy.Url()
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	resp, err := proxied.Get("http://upstream.test" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+// The proxy's HAR once its entries are recorded
+func getHar(t *testing.T, proxy *Proxy) *goharproxy.Har {
+	if err := proxy.Wait(100 * time.Millisecond, 5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	har, err := proxy.GetHar()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return har
+}
+
+func TestClientToken(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{Token: "secret"})
+
+	if _, err := New(client.BaseUrl).CreateProxy(nil); err == nil || err.(*Error).StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected unauthorized error without a token, got: ", err)
+	}
+	newTestProxy(t, client, nil)
+}
+
+func TestClientBasicAuth(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{Username: "alice", Password: "secret"})
+
+	client.Username, client.Password = "alice", "wrong"
+	if _, err := client.CreateProxy(nil); err == nil || err.(*Error).StatusCode != http.StatusUnauthorized {
+		t.Fatal("Expected unauthorized error with a wrong password, got: ", err)
+	}
+	client.Password = "secret"
+	newTestProxy(t, client, nil)
+}
+
+func TestClientProxyOptions(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{
+		ProxyDefaults: url.Values{"cookieJar": {"true"}, "captureContent": {"true"}}})
+	proxy := newTestProxy(t, client, &ProxyOptions{MaxEntries: 10, CookieJar: Bool(false)})
+
+	// Defaults are kept unless overridden, false included
+	info, err := proxy.Info()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Port != proxy.Port || info.CookieJar || !info.CaptureContent || info.MaxEntries != 10 {
+		t.Fatal("Expected the cookie jar default to be overridden, got: ", info)
+	}
+
+	upstreamProxy := newTestProxy(t, client, &ProxyOptions{Upstream: "http://upstream.test:3128"})
+	if info, err := upstreamProxy.Info(); err != nil || info.UpstreamHttp != "http://upstream.test:3128" {
+		t.Fatal("Expected the proxy's upstream, got: ", info, err)
+	}
+}
+
+func TestClientProxy(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	created := newTestProxy(t, client, nil)
+
+	info, err := client.Proxy(created.Port).Info()
+	if err != nil || info.Port != created.Port {
+		t.Fatal("Expected the proxy on the created port, got: ", info, err)
+	}
+	if _, err := client.Proxy(1).Info(); err == nil || err.(*Error).StatusCode != http.StatusNotFound {
+		t.Fatal("Expected not found error for a port without a proxy, got: ", err)
+	}
+}
+
+func TestClientGetHar(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	if status := getThrough(t, proxy, "/recorded"); status != http.StatusOK {
+		t.Fatal("Unexpected status through the proxy: ", status)
+	}
+	har := getHar(t, proxy)
+	if len(har.HarLog.Entries) != 1 {
+		t.Fatal("Expected one entry, got: ", har.HarLog.Entries)
+	}
+	// Urls are recorded as sent upstream, after the host was remapped
+	entryUrl, _ := url.Parse(har.HarLog.Entries[0].Request.Url)
+	if entryUrl.Path != "/recorded" || entryUrl.Host == "upstream.test" {
+		t.Fatal("Unexpected entry url: ", entryUrl)
+	}
+
+	// Getting the HAR clears its entries
+	if har := getHar(t, proxy); len(har.HarLog.Entries) != 0 {
+		t.Fatal("Expected no entries once the HAR was read, got: ", har.HarLog.Entries)
+	}
+}
+
+func TestClientNewPage(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	if err := proxy.NewPage("home", "Home"); err != nil {
+		t.Fatal(err)
+	}
+	getThrough(t, proxy, "/home")
+	if err := proxy.NewPageWithCustom("checkout", "Checkout", map[string]interface{}{"_step": "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	getThrough(t, proxy, "/checkout")
+
+	har := getHar(t, proxy)
+	pages := har.HarLog.Pages
+	if len(pages) != 2 || pages[0].Title != "Home" || pages[1].Title != "Checkout" || pages[1].Custom["_step"] != "pay" {
+		t.Fatal("Unexpected pages: ", pages)
+	}
+	for _, entry := range har.HarLog.Entries {
+		entryUrl, _ := url.Parse(entry.Request.Url)
+		if "/" + entry.PageRef != entryUrl.Path {
+			t.Fatal("Expected entry of ", entryUrl.Path, " to refer to its page, got: ", entry.PageRef)
+		}
+	}
+}
+
+func TestClientBlacklist(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	if err := proxy.Blacklist(`/ads/`, http.StatusNoContent); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Blacklist(`(`, http.StatusNoContent); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for invalid pattern, got: ", err)
+	}
+	if status := getThrough(t, proxy, "/ads/banner"); status != http.StatusNoContent {
+		t.Fatal("Expected blacklisted status, got: ", status)
+	}
+
+	if err := proxy.ClearBlacklist(); err != nil {
+		t.Fatal(err)
+	}
+	if status := getThrough(t, proxy, "/ads/banner"); status != http.StatusOK {
+		t.Fatal("Expected request to go upstream once the blacklist was cleared, got: ", status)
+	}
+}
+
+func TestClientMocks(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	if err := proxy.AddMock(goharproxy.MockRule{Regex: `/mocked$`, Status: http.StatusCreated, Body: "mock"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.AddMock(goharproxy.MockRule{Regex: `(`, Status: http.StatusOK}); err == nil || err.(*Error).StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for invalid mock, got: ", err)
+	}
+	if status := getThrough(t, proxy, "/mocked"); status != http.StatusCreated {
+		t.Fatal("Expected mocked status, got: ", status)
+	}
+
+	if err := proxy.ClearMocks(); err != nil {
+		t.Fatal(err)
+	}
+	if status := getThrough(t, proxy, "/mocked"); status != http.StatusOK {
+		t.Fatal("Expected request to go upstream once the mocks were cleared, got: ", status)
+	}
+}
+
+func TestClientWait(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	getThrough(t, proxy, "/")
+	if err := proxy.Wait(100 * time.Millisecond, 5 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	getThrough(t, proxy, "/")
+	if err := proxy.Wait(time.Minute, 100 * time.Millisecond); err == nil || err.(*Error).StatusCode != http.StatusRequestTimeout {
+		t.Fatal("Expected timeout error while traffic is recent, got: ", err)
+	}
+}
+
+func TestClientDelete(t *testing.T) {
+	client := newTestServer(t, goharproxy.ProxyServerConfig{})
+	proxy := newTestProxy(t, client, nil)
+
+	if err := proxy.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := proxy.GetHar(); err == nil || err.(*Error).StatusCode != http.StatusNotFound {
+		t.Fatal("Expected not found error for deleted proxy, got: ", err)
+	}
+}
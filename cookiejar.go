@@ -0,0 +1,90 @@
+package goharproxy
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Cookie jar
+
+// Cookies servers set during a proxy's session, kept the way a browser would keep them:
+// a cookie replaces the one with the same domain, path and name, and expired cookies are removed.
+type HarCookieJar struct {
+	lock    sync.Mutex
+	cookies map[string]jarCookie
+}
+
+type jarCookie struct {
+	cookie HarCookie
+
+	// Zero for cookies which last until the session ends
+	expires time.Time
+}
+
+func NewHarCookieJar() *HarCookieJar {
+	return &HarCookieJar{cookies : make(map[string]jarCookie)}
+}
+
+// Stores cookies set by a response to a request for u
+func (jar *HarCookieJar) SetCookies(u *url.URL, cookies []HarCookie) {
+	jar.lock.Lock()
+	defer jar.lock.Unlock()
+	now := time.Now()
+	for _, cookie := range cookies {
+		cookie.Domain = strings.ToLower(strings.TrimPrefix(cookie.Domain, "."))
+		if cookie.Domain == "" {
+			cookie.Domain = u.Hostname()
+		}
+		if cookie.Path == "" || !strings.HasPrefix(cookie.Path, "/") {
+			cookie.Path = defaultCookiePath(u.Path)
+		}
+		key := cookie.Domain + ";" + cookie.Path + ";" + cookie.Name
+
+		stored := jarCookie{cookie : cookie}
+		switch {
+		case cookie.MaxAge != nil:
+			stored.expires = now.Add(time.Duration(*cookie.MaxAge) * time.Second)
+		case cookie.Expires != nil:
+			stored.expires = *cookie.Expires
+		}
+		if !stored.expires.IsZero() && !stored.expires.After(now) {
+			delete(jar.cookies, key)
+			continue
+		}
+		jar.cookies[key] = stored
+	}
+}
+
+// The cookies currently in the jar, ordered by domain, path and name
+func (jar *HarCookieJar) Cookies() []HarCookie {
+	jar.lock.Lock()
+	defer jar.lock.Unlock()
+	now := time.Now()
+	keys := make([]string, 0, len(jar.cookies))
+	for key, stored := range jar.cookies {
+		if !stored.expires.IsZero() && !stored.expires.After(now) {
+			delete(jar.cookies, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	cookies := make([]HarCookie, len(keys))
+	for i, key := range keys {
+		cookies[i] = jar.cookies[key].cookie
+	}
+	return cookies
+}
+
+// The directory of the request path, as described in RFC 6265 section 5.1.4
+func defaultCookiePath(path string) string {
+	i := strings.LastIndex(path, "/")
+	if i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
@@ -1,57 +1,66 @@
 package goharproxy
 
 import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
 	"time"
 	"net/http"
 	"net/url"
 	"strings"
-	"log"
 	"io/ioutil"
+	"sort"
+	"strconv"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"unicode/utf8"
 )
 
-var startingEntrySize int = 1000
-
+// Read the specification here: http://www.softwareishard.com/blog/har-12-spec/
 type Har struct {
-	HarLog HarLog	`json:"harLog"`
+	HarLog HarLog	`json:"log"`
 }
 
 type HarLog struct {
 	Version string			`json:"version"`
-	Creator string			`json:"creator"`
-	Browser string			`json:"browser"`
-	Pages   []HarPage		`json:"pages"`
+	Creator HarCreator		`json:"creator"`
+	Browser *HarCreator		`json:"browser,omitempty"`
+	Pages   []HarPage		`json:"pages,omitempty"`
 	Entries []HarEntry		`json:"entries"`
+	Comment string			`json:"comment,omitempty"`
+}
+
+// Describes both the creator and the browser of a log
+type HarCreator struct {
+	Name    string		`json:"name"`
+	Version string		`json:"version"`
+	Comment string		`json:"comment,omitempty"`
 }
 
+// Pages and entries are allocated once there are some
 func newHarLog() *HarLog {
 	harLog := HarLog {
 		Version : "1.2",
-		Creator : "GoHarProxy 0.1",
-		Browser : "",
-		Pages 	: make([]HarPage, 0, 10),
-		Entries : makeNewEntries(),
+		Creator : HarCreator{Name: "GoHarProxy", Version: "0.1"},
 	}
 	return &harLog
 }
 
 func (harLog *HarLog) addEntry(entry ...HarEntry) {
-	entries := harLog.Entries
-	m := len(entries)
-	n := m + len(entry)
-	if n > cap(entries) { // if necessary, reallocate
-		// allocate double what's needed, for future growth.
-		newEntries := make([]HarEntry, (n+1)*2)
-		copy(newEntries, entries)
-		entries = newEntries
-	}
-	entries = entries[0:n]
-	copy(entries[m:n], entry)
-	harLog.Entries = entries
-	log.Println("Added entry ", entry[0].Request.Url)
+	harLog.Entries = append(harLog.Entries, entry...)
 }
 
-func makeNewEntries() []HarEntry {
-	return make([]HarEntry, 0, startingEntrySize)
+type plainHarLog HarLog
+
+// Writes a log without entries with an empty array, as HAR requires
+func (harLog HarLog) MarshalJSON() ([]byte, error) {
+	if harLog.Entries == nil {
+		harLog.Entries = []HarEntry{}
+	}
+	return json.Marshal(plainHarLog(harLog))
 }
 
 
@@ -60,17 +69,27 @@ type HarPage struct {
 	StartedDateTime time.Time		`json:"startedDateTime"`
 	Title           string			`json:"title"`
 	PageTimings     HarPageTimings	`json:"pageTimings"`
+
+	// Custom fields, named with a leading "_"
+	Custom map[string]interface{}	`json:"-"`
 }
 
 type HarEntry struct {
-	PageRef         string			`json:"pageRef"`
+	PageRef         string			`json:"pageref,omitempty"`
 	StartedDateTime time.Time		`json:"startedDateTime"`
-	Time            int64			`json:"time"`
+	Time            float64			`json:"time"`
 	Request         *HarRequest		`json:"request"`
 	Response        *HarResponse	`json:"response"`
+	Cache           HarCache		`json:"cache"`
 	Timings         HarTimings		`json:"timings"`
-	ServerIpAddress string			`json:"serverIpAddress"`
-	Connection      string			`json:"connection"`
+	ServerIpAddress string			`json:"serverIPAddress,omitempty"`
+	Connection      string			`json:"connection,omitempty"`
+
+	// Frames sent over the connection when the request was upgraded to a websocket
+	WebSocketMessages []HarWebSocketMessage	`json:"_webSocketMessages,omitempty"`
+
+	// Custom fields, named with a leading "_", such as the proxy's annotations
+	Custom map[string]interface{}	`json:"-"`
 }
 
 type HarRequest struct {
@@ -80,14 +99,16 @@ type HarRequest struct {
 	Cookies        []HarCookie			`json:"cookies"`
 	Headers        []HarNameValuePair	`json:"headers"`
 	QueryString    []HarNameValuePair	`json:"queryString"`
-	PostData       *HarPostData			`json:"postData"`
+	PostData       *HarPostData			`json:"postData,omitempty"`
 	BodySize       int64				`json:"bodySize"`
 	HeadersSize    int64				`json:"headersSize"`
-}
 
-var captureContent bool = false
+	// Custom fields, named with a leading "_"
+	Custom map[string]interface{}	`json:"-"`
+}
 
-func parseRequest(req *http.Request) *HarRequest {
+// The post data is only kept when capturing content. Errors reading it are logged to logger.
+func parseRequest(req *http.Request, captureContent bool, logger *slog.Logger) *HarRequest {
 	if req == nil {
 		return nil
 	}
@@ -95,164 +116,347 @@ func parseRequest(req *http.Request) *HarRequest {
 		Method 		: req.Method,
 		Url    		: req.URL.String(),
 		HttpVersion : req.Proto,
-		Cookies 	: parseCookies(req.Cookies()),
-		Headers		: parseStringArrMap(req.Header),
-		QueryString : parseStringArrMap((req.URL.Query())),
+		Cookies 	: parseRequestCookies(req.Header),
+		Headers		: parseHeaders(req.Header, req.Host, req.TransferEncoding),
+		QueryString : parseQueryString(req.URL.RawQuery),
 		BodySize	: req.ContentLength,
-		HeadersSize : calcHeaderSize(req.Header),
+		HeadersSize : requestHeadersSize(req),
 	}
 
-	if captureContent && (req.Method == "POST" || req.Method == "PUT") {
-		harRequest.PostData = parsePostData(req)
+	if captureContent && req.ContentLength != 0 && req.Body != nil {
+		harRequest.PostData = parsePostData(req, logger)
 	}
 
 	return &harRequest
 }
 
-func calcHeaderSize(header http.Header) int64 {
-	headerSize := 0
-	for headerName, headerValues := range header {
-		headerSize += len(headerName) + 2
-		for _, v := range headerValues {
-			headerSize += len(v)
+// Size of the request line and headers as they are written on the wire, including the blank line ending them.
+// HTTP/2 headers are compressed, so their size is unknown.
+func requestHeadersSize(req *http.Request) int64 {
+	if req.ProtoMajor == 2 {
+		return -1
+	}
+	requestUri := req.RequestURI
+	if requestUri == "" {
+		requestUri = req.URL.RequestURI()
+	}
+	size := len(req.Method) + len(" ") + len(requestUri) + len(" ") + len(req.Proto) + len("\r\n")
+	if req.Host != "" && req.Header.Get("Host") == "" {
+		size += headerLineSize("Host", req.Host)
+	}
+	return int64(size + headersSize(req.Header, req.TransferEncoding))
+}
+
+// Size of the status line and headers as they are written on the wire, including the blank line ending them.
+// HTTP/2 headers are compressed, so their size is unknown.
+func responseHeadersSize(resp *http.Response) int64 {
+	if resp.ProtoMajor == 2 {
+		return -1
+	}
+	size := len(resp.Proto) + len(" ") + len(resp.Status) + len("\r\n")
+	return int64(size + headersSize(resp.Header, resp.TransferEncoding))
+}
+
+// net/http moves Transfer-Encoding out of the headers, so it is added back here
+func headersSize(header http.Header, transferEncoding []string) int {
+	size := 0
+	for name, values := range header {
+		for _, v := range values {
+			size += headerLineSize(name, v)
+		}
+	}
+	if len(transferEncoding) > 0 && header.Get("Transfer-Encoding") == "" {
+		size += headerLineSize("Transfer-Encoding", strings.Join(transferEncoding, ", "))
+	}
+	return size + len("\r\n")
+}
+
+func headerLineSize(name string, value string) int {
+	return len(name) + len(": ") + len(value) + len("\r\n")
+}
+
+// Keeps the body as sent in text, and when it is a form, each of its fields in params
+func parsePostData(req *http.Request, logger *slog.Logger) *HarPostData {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		logger.Error("Error reading request body", "err", err)
+	}
+	harPostData := HarPostData {
+		MimeType : req.Header.Get("Content-Type"),
+		Params   : make([]HarPostDataParam, 0),
+		Text	 : string(body),
+	}
+
+	mediaType, mediaParams, err := mime.ParseMediaType(harPostData.MimeType)
+	if err != nil {
+		return &harPostData
+	}
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		for _, pair := range parseQueryString(string(body)) {
+			harPostData.Params = append(harPostData.Params, HarPostDataParam{Name: pair.Name, Value: pair.Value})
 		}
+	case "multipart/form-data":
+		params, err := parseMultipart(body, mediaParams["boundary"])
+		if err != nil {
+			logger.Warn("Error parsing multipart body", "err", err)
+		}
+		harPostData.Params = append(harPostData.Params, params...)
 	}
-	return int64(headerSize)
+	return &harPostData
 }
 
-func parsePostData(req *http.Request) *HarPostData {
-	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("Error parsing request to %v: %v\n", req.URL, e)
+// Files are described by their name and content type, their content is only kept in the post data text
+func parseMultipart(body []byte, boundary string) ([]HarPostDataParam, error) {
+	params := make([]HarPostDataParam, 0)
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return params, nil
+		}
+		if err != nil {
+			return params, err
+		}
+		param := HarPostDataParam {
+			Name		: part.FormName(),
+			FileName	: part.FileName(),
+			ContentType : part.Header.Get("Content-Type"),
 		}
-	}()
-
-	harPostData := new(HarPostData)
-	contentType := req.Header["Content-Type"]
-	if contentType == nil {
-		panic("Missing content type in request")
-	}
-	harPostData.MimeType = contentType[0]
-
-	if len(req.PostForm) > 0 {
-		index := 0
-		params := make([]HarPostDataParam, len(req.PostForm))
-		for k, v := range req.PostForm {
-			param := HarPostDataParam {
-				Name  : k,
-				Value : strings.Join(v, ","),
+		if param.FileName == "" {
+			value, err := ioutil.ReadAll(part)
+			if err != nil {
+				return params, err
 			}
-			params[index] = param
-			index++
+			param.Value = string(value)
 		}
-		harPostData.Params = params
-	} else {
-		str, _ := ioutil.ReadAll(req.Body)
-		harPostData.Text = string(str)
+		params = append(params, param)
 	}
-	return harPostData
 }
 
+// One pair per header line, for messages whose header bytes weren't kept, see headerBlockPairs.
+// net/http neither keeps the order headers arrived in nor their casing, so headers are sorted by name
+// to keep HARs stable, while repeated headers keep their own order.
+// Host and Transfer-Encoding are added back, as net/http moves them out of the headers.
+func parseHeaders(header http.Header, host string, transferEncoding []string) []HarNameValuePair {
+	harHeaders := make([]HarNameValuePair, 0, len(header) + 2)
+	if host != "" && header.Get("Host") == "" {
+		harHeaders = append(harHeaders, HarNameValuePair{Name: "Host", Value: host})
+	}
+	if len(transferEncoding) > 0 && header.Get("Transfer-Encoding") == "" {
+		harHeaders = append(harHeaders, HarNameValuePair{Name: "Transfer-Encoding", Value: strings.Join(transferEncoding, ", ")})
+	}
+	for name, values := range header {
+		for _, v := range values {
+			harHeaders = append(harHeaders, HarNameValuePair{Name: name, Value: v})
+		}
+	}
+	sort.SliceStable(harHeaders, func(i, j int) bool {
+		return harHeaders[i].Name < harHeaders[j].Name
+	})
+	return harHeaders
+}
 
-func parseStringArrMap(stringArrMap map[string][]string) []HarNameValuePair {
-	index := 0
-	harQueryString := make([]HarNameValuePair, len(stringArrMap))
-	for k, v := range stringArrMap {
-		escapedKey, _ 	 := url.QueryUnescape(k)
-		escapedValues, _ := url.QueryUnescape(strings.Join(v, ","))
-		harNameValuePair := HarNameValuePair {
-			Name  : escapedKey,
-			Value : escapedValues,
+// One pair per parameter, in the order they appear in the url
+func parseQueryString(rawQuery string) []HarNameValuePair {
+	harQueryString := make([]HarNameValuePair, 0)
+	for _, param := range strings.Split(rawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
 		}
-		harQueryString[index] = harNameValuePair
-		index++
+		harQueryString = append(harQueryString, HarNameValuePair {
+			Name  : queryUnescape(name),
+			Value : queryUnescape(value),
+		})
 	}
 	return harQueryString
 }
 
-func parseCookies(cookies []*http.Cookie) []HarCookie {
-	harCookies := make([]HarCookie, len(cookies))
-	for i, cookie := range cookies {
-		harCookie := HarCookie {
-			Name 	 : cookie.Name,
-			Domain 	 : cookie.Domain,
-			Expires  : cookie.Expires,
-			HttpOnly : cookie.HttpOnly,
-			Path 	 : cookie.Path,
-			Secure 	 : cookie.Secure,
-			Value 	 : cookie.Value,
+// Keeps the raw string when it is not properly escaped
+func queryUnescape(s string) string {
+	if unescaped, err := url.QueryUnescape(s); err == nil {
+		return unescaped
 	}
-		harCookies[i] = harCookie
+	return s
+}
+
+// Cookies the client sent, with their values exactly as sent
+func parseRequestCookies(header http.Header) []HarCookie {
+	harCookies := make([]HarCookie, 0)
+	for _, line := range header["Cookie"] {
+		for _, pair := range strings.Split(line, ";") {
+			name, value := splitCookiePair(pair)
+			if name == "" {
+				continue
+			}
+			harCookies = append(harCookies, HarCookie{Name: name, Value: value})
+		}
+	}
+	return harCookies
+}
+
+// Cookies the server set, with every attribute of their Set-Cookie header.
+// Unlike http.Response.Cookies, values are kept as sent, and cookies net/http considers invalid are kept.
+func parseSetCookies(header http.Header) []HarCookie {
+	harCookies := make([]HarCookie, 0)
+	for _, line := range header["Set-Cookie"] {
+		parts := strings.Split(line, ";")
+		name, value := splitCookiePair(parts[0])
+		if name == "" {
+			continue
+		}
+		harCookie := HarCookie{Name: name, Value: value}
+		for _, attribute := range parts[1:] {
+			attributeName, attributeValue := splitCookiePair(attribute)
+			switch strings.ToLower(attributeName) {
+			case "path":
+				harCookie.Path = attributeValue
+			case "domain":
+				harCookie.Domain = attributeValue
+			case "expires":
+				if expires, ok := parseCookieTime(attributeValue); ok {
+					harCookie.Expires = &expires
+				}
+			case "max-age":
+				if maxAge, err := strconv.Atoi(attributeValue); err == nil {
+					harCookie.MaxAge = &maxAge
+				}
+			case "secure":
+				harCookie.Secure = true
+			case "httponly":
+				harCookie.HttpOnly = true
+			case "samesite":
+				harCookie.SameSite = attributeValue
+			case "priority":
+				harCookie.Priority = attributeValue
+			case "partitioned":
+				harCookie.Partitioned = true
+			}
+		}
+		harCookies = append(harCookies, harCookie)
 	}
 	return harCookies
 }
 
+func splitCookiePair(pair string) (string, string) {
+	pair = strings.TrimSpace(pair)
+	if i := strings.Index(pair, "="); i >= 0 {
+		return strings.TrimSpace(pair[:i]), strings.TrimSpace(pair[i+1:])
+	}
+	return pair, ""
+}
+
+var cookieTimeFormats = []string{time.RFC1123, "Mon, 02-Jan-2006 15:04:05 MST", time.RFC850, time.ANSIC}
+
+func parseCookieTime(value string) (time.Time, bool) {
+	for _, format := range cookieTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
 type HarResponse struct {
 	Status             int					`json:"status"`
 	StatusText         string				`json:"statusText"`
-	HttpVersion        string				`json:"httpVersion`
+	HttpVersion        string				`json:"httpVersion"`
 	Cookies            []HarCookie			`json:"cookies"`
 	Headers            []HarNameValuePair	`json:"headers"`
 	Content            *HarContent			`json:"content"`
-	RedirectUrl        string				`json:"redirectUrl"`
+	RedirectUrl        string				`json:"redirectURL"`
 	BodySize           int64				`json:"bodySize"`
 	HeadersSize        int64				`json:"headersSize"`
+
+	// Why no response was received, the same way Chrome DevTools reports failed requests
+	Error              string				`json:"_error,omitempty"`
+
+	// Custom fields, named with a leading "_"
+	Custom map[string]interface{}	`json:"-"`
 }
 
-func parseResponse(resp *http.Response) *HarResponse {
+// The content text is only kept when capturing content. Errors reading it are logged to logger.
+func parseResponse(resp *http.Response, captureContent bool, logger *slog.Logger) *HarResponse {
 	if resp == nil {
 		return nil
 	}
 
 	harResponse := HarResponse {
 		Status			: resp.StatusCode,
-		StatusText		: resp.Status,
+		StatusText		: strings.TrimPrefix(resp.Status, strconv.Itoa(resp.StatusCode) + " "),
 		HttpVersion		: resp.Proto,
-		Cookies			: parseCookies(resp.Cookies()),
-		Headers			: parseStringArrMap(resp.Header),
-		RedirectUrl		: "",
+		Cookies			: parseSetCookies(resp.Header),
+		Headers			: parseHeaders(resp.Header, "", resp.TransferEncoding),
+		Content			: parseContent(resp, captureContent, logger),
+		RedirectUrl		: resp.Header.Get("Location"),
 		BodySize		: resp.ContentLength,
-		HeadersSize		: calcHeaderSize(resp.Header),
-	}
-
-	if captureContent {
-		harResponse.Content = parseContent(resp)
+		HeadersSize		: responseHeadersSize(resp),
 	}
 
 	return &harResponse
 }
 
-func parseContent(resp *http.Response) *HarContent{
-	defer func() {
-		if e := recover(); e != nil {
-			log.Printf("Error parsing response to %v: %v\n", resp.Request.URL, e)
-		}
-	}()
+// Describes a request which got no response
+func errorResponse(err error) *HarResponse {
+	if err == nil {
+		err = errors.New("No response received")
+	}
+	return &HarResponse {
+		Cookies		: make([]HarCookie, 0),
+		Headers		: make([]HarNameValuePair, 0),
+		Content		: &HarContent{MimeType: "x-unknown"},
+		BodySize	: -1,
+		HeadersSize : -1,
+		Error		: err.Error(),
+	}
+}
 
-	harContent := new(HarContent)
-	contentType := resp.Header["Content-Type"]
-	if contentType == nil {
-		panic("Missing content type in response")
+// Content text is only kept when capturing content, binary content is base64 encoded
+func parseContent(resp *http.Response, captureContent bool, logger *slog.Logger) *HarContent {
+	harContent := HarContent {
+		Size	 : resp.ContentLength,
+		MimeType : resp.Header.Get("Content-Type"),
 	}
-	harContent.MimeType = contentType[0]
-	if (resp.ContentLength <= 0) {
-		log.Println("Empty content")
-		return nil
+	if harContent.Size < 0 {
+		harContent.Size = 0
+	}
+	if !captureContent || resp.Body == nil {
+		return &harContent
 	}
 
-	body, _ := ioutil.ReadAll(resp.Body)
-	harContent.Text = string(body)
-	return harContent
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		logger.Error("Error reading response body", "err", err)
+	}
+	harContent.Size = int64(len(body))
+	if utf8.Valid(body) {
+		harContent.Text = string(body)
+	} else {
+		harContent.Text = base64.StdEncoding.EncodeToString(body)
+		harContent.Encoding = "base64"
+	}
+	return &harContent
 }
 
+// Attributes a cookie was not set with are left out
 type HarCookie struct {
 	Name     string			`json:"name"`
 	Value    string			`json:"value"`
-	Path     string			`json:"path"`
-	Domain   string			`json:"domain"`
-	Expires  time.Time		`json:"expires"`
-	HttpOnly bool			`json:"httpOnly"`
-	Secure   bool			`json:"secure"`
+	Path     string			`json:"path,omitempty"`
+	Domain   string			`json:"domain,omitempty"`
+	Expires  *time.Time		`json:"expires,omitempty"`
+	HttpOnly bool			`json:"httpOnly,omitempty"`
+	Secure   bool			`json:"secure,omitempty"`
+	SameSite string			`json:"sameSite,omitempty"`
+
+	// Not part of HAR 1.2, so they are prefixed by an underscore
+	MaxAge      *int		`json:"_maxAge,omitempty"`
+	Priority    string		`json:"_priority,omitempty"`
+	Partitioned bool		`json:"_partitioned,omitempty"`
 }
 
 type HarNameValuePair struct {
@@ -268,32 +472,59 @@ type HarPostData struct {
 
 type HarPostDataParam struct {
 	Name        string		`json:"name"`
-	Value       string		`json:"value"`
-	FileName    string		`json:"fileName"`
-	ContentType string		`json:"contentType`
+	Value       string		`json:"value,omitempty"`
+	FileName    string		`json:"fileName,omitempty"`
+	ContentType string		`json:"contentType,omitempty"`
 }
 
 type HarContent struct {
 	Size        int64		`json:"size"`
-	Compression int64		`json:"compression"`
+	Compression int64		`json:"compression,omitempty"`
 	MimeType    string		`json:"mimeType"`
-	Text        string		`json:"text"`
-	Encoding    string		`json:"encoding"`
+	Text        string		`json:"text,omitempty"`
+	Encoding    string		`json:"encoding,omitempty"`
+}
+
+// We keep no cache, so both states are always left out
+type HarCache struct {
+	BeforeRequest *HarCacheState	`json:"beforeRequest,omitempty"`
+	AfterRequest  *HarCacheState	`json:"afterRequest,omitempty"`
+}
+
+type HarCacheState struct {
+	Expires    string		`json:"expires,omitempty"`
+	LastAccess string		`json:"lastAccess"`
+	ETag       string		`json:"eTag"`
+	HitCount   int			`json:"hitCount"`
 }
 
 type HarPageTimings struct {
-	OnContentLoad int64		`json:"onContentLoad"`
-	OnLoad        int64		`json:"onLoad"`
+	OnContentLoad float64		`json:"onContentLoad"`
+	OnLoad        float64		`json:"onLoad"`
 }
 
+// Phases which do not apply, or which we could not measure, are -1
 type HarTimings struct {
-	Blocked int64
-	Dns     int64
-	Connect int64
-	Send    int64
-	Wait    int64
-	Receive int64
-	Ssl     int64
+	Blocked float64		`json:"blocked"`
+	Dns     float64		`json:"dns"`
+	Connect float64		`json:"connect"`
+	Send    float64		`json:"send"`
+	Wait    float64		`json:"wait"`
+	Receive float64		`json:"receive"`
+	Ssl     float64		`json:"ssl"`
+}
+
+// We only know how long the whole request took, which we count as waiting for the response
+func newHarTimings(total float64) HarTimings {
+	return HarTimings {
+		Blocked : -1,
+		Dns		: -1,
+		Connect : -1,
+		Send	: 0,
+		Wait	: total,
+		Receive : 0,
+		Ssl		: -1,
+	}
 }
 
 
@@ -0,0 +1,170 @@
+package goharproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Custom fields
+
+// HAR objects with a Custom field carry the custom fields HAR 1.2 allows, named with a leading "_".
+// They are written after the object's own fields and read back from any "_" field the object does not define.
+
+// Types with the same fields as our HAR objects, without their json methods
+type plainHarEntry HarEntry
+type plainHarPage HarPage
+type plainHarRequest HarRequest
+type plainHarResponse HarResponse
+
+func (entry HarEntry) MarshalJSON() ([]byte, error) {
+	return marshalWithCustom(plainHarEntry(entry), entry.Custom)
+}
+
+func (entry *HarEntry) UnmarshalJSON(data []byte) error {
+	return unmarshalWithCustom(data, (*plainHarEntry)(entry), &entry.Custom)
+}
+
+func (page HarPage) MarshalJSON() ([]byte, error) {
+	return marshalWithCustom(plainHarPage(page), page.Custom)
+}
+
+func (page *HarPage) UnmarshalJSON(data []byte) error {
+	return unmarshalWithCustom(data, (*plainHarPage)(page), &page.Custom)
+}
+
+func (request HarRequest) MarshalJSON() ([]byte, error) {
+	return marshalWithCustom(plainHarRequest(request), request.Custom)
+}
+
+func (request *HarRequest) UnmarshalJSON(data []byte) error {
+	return unmarshalWithCustom(data, (*plainHarRequest)(request), &request.Custom)
+}
+
+func (response HarResponse) MarshalJSON() ([]byte, error) {
+	return marshalWithCustom(plainHarResponse(response), response.Custom)
+}
+
+func (response *HarResponse) UnmarshalJSON(data []byte) error {
+	return unmarshalWithCustom(data, (*plainHarResponse)(response), &response.Custom)
+}
+
+// Appends the custom fields, ordered by name, to the json of v.
+// Fields without a leading "_", or which v already has, are left out.
+func marshalWithCustom(v interface{}, custom map[string]interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil || len(custom) == 0 {
+		return data, err
+	}
+	fields := jsonFieldNames(reflect.TypeOf(v))
+	names := make([]string, 0, len(custom))
+	for name := range custom {
+		if isCustomField(name) && !fields[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	buf := bytes.NewBuffer(data[:len(data)-1])
+	for _, name := range names {
+		value, err := json.Marshal(custom[name])
+		if err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// Reads data into v, and the "_" fields v does not have into custom
+func unmarshalWithCustom(data []byte, v interface{}, custom *map[string]interface{}) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		// Not an object, such as null, which leaves v as it is
+		return nil
+	}
+	fields := jsonFieldNames(reflect.TypeOf(v).Elem())
+	*custom = nil
+	for name, raw := range values {
+		if !isCustomField(name) || fields[name] {
+			continue
+		}
+		var value interface{}
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return err
+		}
+		if *custom == nil {
+			*custom = make(map[string]interface{})
+		}
+		(*custom)[name] = value
+	}
+	return nil
+}
+
+func isCustomField(name string) bool {
+	return strings.HasPrefix(name, "_") && len(name) > 1
+}
+
+var jsonFieldNamesCache sync.Map
+
+// The names of the fields of struct type t in json
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	if names, ok := jsonFieldNamesCache.Load(t); ok {
+		return names.(map[string]bool)
+	}
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		names[name] = true
+	}
+	jsonFieldNamesCache.Store(t, names)
+	return names
+}
+
+// A copy of custom fields, failing on names without a leading "_", what naming them in the error
+func copyCustom(custom map[string]interface{}, what string) (map[string]interface{}, error) {
+	copied := make(map[string]interface{}, len(custom))
+	for name, value := range custom {
+		if !isCustomField(name) {
+			return nil, fmt.Errorf("Invalid %v [%v], names must start with _", what, name)
+		}
+		copied[name] = value
+	}
+	return copied, nil
+}
+
+// Copies custom fields into a new map, keeping those already in dst
+func mergeCustom(dst map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	if len(src) == 0 {
+		return dst
+	}
+	merged := make(map[string]interface{}, len(dst) + len(src))
+	for name, value := range src {
+		merged[name] = value
+	}
+	for name, value := range dst {
+		merged[name] = value
+	}
+	return merged
+}
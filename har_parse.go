@@ -0,0 +1,204 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HAR parsing
+
+// Custom fields we read into our types, with the json type they must have.
+// Other tools may use the same names for something else, so values of another type are ignored rather than failing the parse.
+var harCustomFieldKinds = map[string]string {
+	"_webSocketMessages" : "array",
+	"_error"			 : "string",
+	"_maxAge"			 : "number",
+	"_priority"			 : "string",
+	"_partitioned"		 : "boolean",
+}
+
+// Dates written by other tools which are not quite ISO 8601 as we write it
+var harTimeFormats = []string{time.RFC3339Nano, "2006-01-02T15:04:05Z0700", "2006-01-02T15:04:05"}
+
+// ParseHar reads a HAR written by a browser, another proxy or an older version of goharproxy.
+// It accepts a "log" root, the "harLog" root we used to write, or a bare log,
+// and ignores the fields it does not know, except custom fields starting with "_" which are kept in Custom.
+// Field names differing from ours only by case, such as "pageRef", are read as ours.
+func ParseHar(r io.Reader) (*Har, error) {
+	var document map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&document); err != nil {
+		return nil, err
+	}
+	harLog, ok := findHarLog(document)
+	if !ok {
+		return nil, errors.New("Missing HAR log")
+	}
+	normalizeHarValue(harLog)
+	normalizeHarLog(harLog)
+
+	data, err := json.Marshal(harLog)
+	if err != nil {
+		return nil, err
+	}
+	har := new(Har)
+	if err := json.Unmarshal(data, &har.HarLog); err != nil {
+		return nil, err
+	}
+	return har, nil
+}
+
+func findHarLog(document map[string]interface{}) (map[string]interface{}, bool) {
+	for _, key := range []string{"log", "harLog"} {
+		if harLog, ok := document[key].(map[string]interface{}); ok {
+			return harLog, true
+		}
+	}
+	if _, ok := document["entries"]; ok {
+		return document, true
+	}
+	return nil, false
+}
+
+// Drops custom fields we cannot read into our types
+func normalizeHarValue(value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			if kind, ok := harCustomFieldKinds[key]; ok && jsonKind(field) != kind {
+				delete(value, key)
+				continue
+			}
+			normalizeHarValue(field)
+		}
+	case []interface{}:
+		for _, item := range value {
+			normalizeHarValue(item)
+		}
+	}
+}
+
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+func normalizeHarLog(harLog map[string]interface{}) {
+	for _, key := range []string{"creator", "browser"} {
+		if creator, ok := harLog[key].(string); ok {
+			harLog[key] = parseHarCreator(creator)
+		}
+	}
+	for _, page := range harObjects(harLog["pages"]) {
+		normalizeHarTime(page, "startedDateTime")
+	}
+	for _, entry := range harObjects(harLog["entries"]) {
+		normalizeHarTime(entry, "startedDateTime")
+		for _, key := range []string{"request", "response"} {
+			if message, ok := entry[key].(map[string]interface{}); ok {
+				for _, cookie := range harObjects(message["cookies"]) {
+					normalizeHarTime(cookie, "expires")
+				}
+			}
+		}
+	}
+}
+
+// Splits creators written as a single "GoHarProxy 0.1" string
+func parseHarCreator(creator string) interface{} {
+	if creator == "" {
+		return nil
+	}
+	name, version := creator, ""
+	if i := strings.LastIndex(creator, " "); i > 0 {
+		name, version = creator[:i], creator[i+1:]
+	}
+	return map[string]interface{}{"name": name, "version": version}
+}
+
+func harObjects(value interface{}) []map[string]interface{} {
+	items, _ := value.([]interface{})
+	objects := make([]map[string]interface{}, 0, len(items))
+	for _, item := range items {
+		if object, ok := item.(map[string]interface{}); ok {
+			objects = append(objects, object)
+		}
+	}
+	return objects
+}
+
+// Rewrites a date in the format we read, dropping it when we cannot make sense of it
+func normalizeHarTime(object map[string]interface{}, key string) {
+	value, ok := object[key].(string)
+	if ok {
+		for _, format := range harTimeFormats {
+			if t, err := time.Parse(format, value); err == nil {
+				object[key] = t.Format(time.RFC3339Nano)
+				return
+			}
+		}
+		if t, ok := parseCookieTime(value); ok {
+			object[key] = t.Format(time.RFC3339Nano)
+			return
+		}
+	}
+	delete(object, key)
+}
+
+// MergeHarLogs combines logs into a single log, with entries ordered by the time they started.
+// When logs have pages with the same id, the first one is kept.
+func MergeHarLogs(logs ...*HarLog) *HarLog {
+	merged := newHarLog()
+	pageIds := make(map[string]bool)
+	for _, harLog := range logs {
+		for _, page := range harLog.Pages {
+			if !pageIds[page.Id] {
+				pageIds[page.Id] = true
+				merged.Pages = append(merged.Pages, page)
+			}
+		}
+		merged.Entries = append(merged.Entries, harLog.Entries...)
+	}
+	sort.SliceStable(merged.Entries, func(i, j int) bool {
+		return merged.Entries[i].StartedDateTime.Before(merged.Entries[j].StartedDateTime)
+	})
+	return merged
+}
+
+// Filter returns a log with the entries keep returns true for, and the pages they refer to
+func (harLog *HarLog) Filter(keep func(entry *HarEntry) bool) *HarLog {
+	filtered := &HarLog{
+		Version : harLog.Version,
+		Creator : harLog.Creator,
+		Browser : harLog.Browser,
+		Comment : harLog.Comment,
+		Entries : make([]HarEntry, 0),
+	}
+	pageRefs := make(map[string]bool)
+	for i := range harLog.Entries {
+		if keep(&harLog.Entries[i]) {
+			filtered.Entries = append(filtered.Entries, harLog.Entries[i])
+			pageRefs[harLog.Entries[i].PageRef] = true
+		}
+	}
+	for _, page := range harLog.Pages {
+		if pageRefs[page.Id] {
+			filtered.Pages = append(filtered.Pages, page)
+		}
+	}
+	return filtered
+}
@@ -8,6 +8,12 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"bufio"
+	"time"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"log/slog"
 )
 
 func TestParseHttpGETRequest (t *testing.T) {
@@ -22,7 +28,7 @@ func TestParseHttpGETRequest (t *testing.T) {
 		BodySize 	: 0,
 	}
 
-	if harReq := parseRequest(req); reflect.DeepEqual(expectedReq, harReq) {
+	if harReq := parseRequest(req, false, slog.Default()); reflect.DeepEqual(expectedReq, harReq) {
 		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expectedReq, harReq)
 	}
 }
@@ -40,7 +46,7 @@ func TestParseIpString (t *testing.T) {
 		BodySize 	: 0,
 	}
 
-	if harReq := parseRequest(req); reflect.DeepEqual(expectedReq, harReq) {
+	if harReq := parseRequest(req, false, slog.Default()); reflect.DeepEqual(expectedReq, harReq) {
 		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expectedReq, harReq)
 	}
 }
@@ -57,23 +63,21 @@ func TestParseHttpIpGETRequest (t *testing.T) {
 		BodySize 	: 0,
 	}
 
-	if harReq := parseRequest(req); reflect.DeepEqual(expectedReq, harReq) {
+	if harReq := parseRequest(req, false, slog.Default()); reflect.DeepEqual(expectedReq, harReq) {
 		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expectedReq, harReq)
 	}
 }
 
 func TestParseHttpPOSTRequest (t *testing.T) {
 	req, expectedReq := getTestSendRequest("POST", t)
-	captureContent = true
-	if harReq := parseRequest(req); reflect.DeepEqual(expectedReq, harReq) {
+	if harReq := parseRequest(req, true, slog.Default()); reflect.DeepEqual(expectedReq, harReq) {
 		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expectedReq, harReq)
 	}
 }
 
 func TestParseHttpPUTRequest (t *testing.T) {
 	req, expectedReq := getTestSendRequest("PUT", t)
-	captureContent = true
-	if harReq := parseRequest(req); reflect.DeepEqual(expectedReq, harReq) {
+	if harReq := parseRequest(req, true, slog.Default()); reflect.DeepEqual(expectedReq, harReq) {
 		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expectedReq, harReq)
 	}
 }
@@ -87,12 +91,297 @@ func TestParsePostDataRaw(t *testing.T) {
 	req.Header.Add("Content-Type", "Raw")
 	contentLength := strconv.Itoa(len(testString))
 	req.Header.Add("Content-Length", contentLength)
-	postData := parsePostData(req)
+	postData := parsePostData(req, slog.Default())
 	if postData.Text != testString {
 		t.Fatal("Did not get expected text")
 	}
 }
 
+func TestRequestHeadersSize(t *testing.T) {
+	head := "GET http://google.com/search?q=go HTTP/1.1\r\nHost: google.com\r\nAccept: */*\r\n" +
+		"Transfer-Encoding: chunked\r\nCookie: a=b\r\nCookie: c=d\r\n\r\n"
+	req, err := http.ReadRequest(bufio.NewReader(strings.NewReader(head + "0\r\n\r\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := requestHeadersSize(req); size != int64(len(head)) {
+		t.Fatalf("Expected headers size %v but got %v", len(head), size)
+	}
+}
+
+func TestResponseHeadersSize(t *testing.T) {
+	head := "HTTP/1.1 200 OK\r\nSet-Cookie: a=b\r\nSet-Cookie: c=d\r\nContent-Length: 3\r\n\r\n"
+	resp, err := http.ReadResponse(bufio.NewReader(strings.NewReader(head + "bla")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := responseHeadersSize(resp); size != int64(len(head)) {
+		t.Fatalf("Expected headers size %v but got %v", len(head), size)
+	}
+}
+
+func TestParseHeadersOnePairPerLine(t *testing.T) {
+	header := http.Header{}
+	header.Add("Set-Cookie", "a=b; Path=/")
+	header.Add("Set-Cookie", "c=d%20e")
+	header.Add("Content-Type", "text/plain")
+
+	expected := []HarNameValuePair{
+		{Name: "Content-Type", Value: "text/plain"},
+		{Name: "Set-Cookie", Value: "a=b; Path=/"},
+		{Name: "Set-Cookie", Value: "c=d%20e"},
+	}
+	if harHeaders := parseHeaders(header, "", nil); !reflect.DeepEqual(expected, harHeaders) {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, harHeaders)
+	}
+}
+
+func TestParseQueryStringInOrder(t *testing.T) {
+	expected := []HarNameValuePair{
+		{Name: "z", Value: "1"},
+		{Name: "a b", Value: "2"},
+		{Name: "z", Value: "3"},
+		{Name: "flag", Value: ""},
+	}
+	if harQueryString := parseQueryString("z=1&a+b=2&z=3&flag"); !reflect.DeepEqual(expected, harQueryString) {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, harQueryString)
+	}
+}
+
+func TestParseSetCookies(t *testing.T) {
+	header := http.Header{}
+	header.Add("Set-Cookie", `id="a b"; Path=/; Domain=.google.com; Max-Age=60; Secure; HttpOnly; SameSite=Lax`)
+	header.Add("Set-Cookie", "session=1; Expires=Wed, 21 Oct 2015 07:28:00 GMT")
+
+	harCookies := parseSetCookies(header)
+	if len(harCookies) != 2 {
+		t.Fatal("Expected 2 cookies but got: ", harCookies)
+	}
+	maxAge := 60
+	expected := HarCookie{Name: "id", Value: `"a b"`, Path: "/", Domain: ".google.com", MaxAge: &maxAge,
+		Secure: true, HttpOnly: true, SameSite: "Lax"}
+	if !reflect.DeepEqual(expected, harCookies[0]) {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, harCookies[0])
+	}
+	if harCookies[1].Expires == nil || !harCookies[1].Expires.Equal(time.Date(2015, 10, 21, 7, 28, 0, 0, time.UTC)) {
+		t.Error("Did not parse expires: ", harCookies[1].Expires)
+	}
+
+	str, _ := json.Marshal(HarCookie{Name: "a", Value: "b"})
+	if string(str) != `{"name":"a","value":"b"}` {
+		t.Error("Expected unset cookie attributes to be left out, got: ", string(str))
+	}
+}
+
+func TestParseRequestCookies(t *testing.T) {
+	header := http.Header{}
+	header.Add("Cookie", `a=1; b="2"`)
+	expected := []HarCookie{{Name: "a", Value: "1"}, {Name: "b", Value: `"2"`}}
+	if harCookies := parseRequestCookies(header); !reflect.DeepEqual(expected, harCookies) {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, harCookies)
+	}
+}
+
+func TestCookieJar(t *testing.T) {
+	jar := NewHarCookieJar()
+	u, _ := url.Parse("http://google.com/a/b")
+	zero := 0
+	jar.SetCookies(u, []HarCookie{{Name: "a", Value: "1"}, {Name: "b", Value: "1"}})
+	jar.SetCookies(u, []HarCookie{{Name: "a", Value: "2"}, {Name: "b", Value: "", MaxAge: &zero}})
+
+	expected := []HarCookie{{Name: "a", Value: "2", Domain: "google.com", Path: "/a"}}
+	if cookies := jar.Cookies(); !reflect.DeepEqual(expected, cookies) {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, cookies)
+	}
+}
+
+func TestParsePostDataForm(t *testing.T) {
+	req, err := http.NewRequest("PATCH", "http://google.com", strings.NewReader("b=2&a=1&a=3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	postData := parsePostData(req, slog.Default())
+	expected := []HarPostDataParam{{Name: "b", Value: "2"}, {Name: "a", Value: "1"}, {Name: "a", Value: "3"}}
+	if !reflect.DeepEqual(expected, postData.Params) || postData.Text != "b=2&a=1&a=3" {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, postData)
+	}
+}
+
+func TestParsePostDataMultipart(t *testing.T) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("name", "foo")
+	file, _ := writer.CreateFormFile("upload", "bar.txt")
+	io.WriteString(file, "file content")
+	writer.Close()
+
+	req, err := http.NewRequest("POST", "http://google.com", bytes.NewReader(body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	postData := parsePostData(req, slog.Default())
+	expected := []HarPostDataParam{
+		{Name: "name", Value: "foo"},
+		{Name: "upload", FileName: "bar.txt", ContentType: "application/octet-stream"},
+	}
+	if !reflect.DeepEqual(expected, postData.Params) || postData.Text != body.String() {
+		t.Errorf("Expected:\n %v \n\n Actual:\n %v \n\n", expected, postData)
+	}
+}
+
+func TestParsePostDataWithoutContentType(t *testing.T) {
+	req, err := http.NewRequest("DELETE", "http://google.com", strings.NewReader("BLA"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	harReq := parseRequest(req, true, slog.Default())
+	if harReq.PostData == nil || harReq.PostData.Text != "BLA" || harReq.PostData.MimeType != "" {
+		t.Fatal("Expected raw text without mime type, got: ", harReq.PostData)
+	}
+}
+
+func TestValidateHarRejectsInvalid(t *testing.T) {
+	invalid := []string{
+		`{"harLog": {"version": "1.2", "creator": {"name": "GoHarProxy", "version": "0.1"}, "entries": []}}`,
+		`{"log": {"version": "1.2", "creator": {"name": "GoHarProxy"}, "entries": []}}`,
+		`{"log": {"version": "1.2", "creator": {"name": "GoHarProxy", "version": "0.1"}, "entries": [{}]}}`,
+		`{"log": {"version": "1.2", "creator": {"name": "GoHarProxy", "version": "0.1"}, "entries": [], "pages": {}}}`,
+	}
+	for _, har := range invalid {
+		if err := ValidateHar([]byte(har)); err == nil {
+			t.Fatal("Expected validation error for: ", har)
+		}
+	}
+	valid := `{"log": {"version": "1.2", "creator": {"name": "GoHarProxy", "version": "0.1"}, "entries": [], "_custom": 1}}`
+	if err := ValidateHar([]byte(valid)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseHarBrowser(t *testing.T) {
+	browserHar := `{"log": {"version": "1.2", "creator": {"name": "WebInspector", "version": "537.36"},
+		"pages": [{"startedDateTime": "2024-01-02T03:04:05.678Z", "id": "page_1", "title": "Example",
+			"pageTimings": {"onContentLoad": 120.5, "onLoad": -1}}],
+		"entries": [{"_initiator": {"type": "other"}, "_priority": "VeryHigh", "_error": {"code": 1},
+			"pageref": "page_1", "startedDateTime": "2024-01-02T03:04:05.700Z", "time": 42.125,
+			"request": {"method": "GET", "url": "http://example.com/", "httpVersion": "HTTP/1.1",
+				"headers": [{"name": "Host", "value": "example.com"}], "queryString": [],
+				"cookies": [{"name": "a", "value": "b", "expires": null}], "headersSize": -1, "bodySize": 0},
+			"response": {"status": 200, "statusText": "OK", "httpVersion": "HTTP/1.1", "headers": [],
+				"cookies": [{"name": "c", "value": "d", "expires": "Wed, 09 Jun 2021 10:18:14 GMT"}],
+				"content": {"size": 5, "mimeType": "text/plain", "text": "hello"},
+				"redirectURL": "", "headersSize": -1, "bodySize": 5, "_transferSize": 100},
+			"cache": {}, "timings": {"blocked": 1.5, "dns": -1, "ssl": -1, "connect": -1, "send": 0.25,
+				"wait": 40, "receive": 0.375}}]}}`
+
+	har, err := ParseHar(strings.NewReader(browserHar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	harLog := har.HarLog
+	if harLog.Creator.Name != "WebInspector" || len(harLog.Pages) != 1 || len(harLog.Entries) != 1 {
+		t.Fatal("Unexpected log: ", harLog)
+	}
+	entry := harLog.Entries[0]
+	if entry.Time != 42.125 || entry.Timings.Receive != 0.375 || entry.PageRef != "page_1" {
+		t.Fatal("Unexpected entry: ", entry)
+	}
+	if entry.Response.Error != "" || entry.Response.Content.Text != "hello" {
+		t.Fatal("Unexpected response: ", entry.Response)
+	}
+	expires := time.Date(2021, 6, 9, 10, 18, 14, 0, time.UTC)
+	if cookie := entry.Response.Cookies[0]; cookie.Expires == nil || !cookie.Expires.Equal(expires) {
+		t.Fatal("Unexpected cookie: ", cookie)
+	}
+	if entry.Request.Cookies[0].Expires != nil {
+		t.Fatal("Expected cookie without expiry, got: ", entry.Request.Cookies[0])
+	}
+}
+
+func TestParseHarLegacy(t *testing.T) {
+	legacyHar := `{"harLog": {"version": "1.2", "creator": "GoHarProxy 0.1", "browser": "", "pages": [],
+		"entries": [{"pageRef": "", "startedDateTime": "2015-03-04T05:06:07.123456789+02:00", "time": 12,
+			"request": {"method": "GET", "url": "http://example.com/"},
+			"response": {"status": 200, "HttpVersion": "HTTP/1.1"},
+			"timings": {"Blocked": 0, "Wait": 12}, "serverIpAddress": "10.0.0.1", "connection": ""}]}}`
+
+	har, err := ParseHar(strings.NewReader(legacyHar))
+	if err != nil {
+		t.Fatal(err)
+	}
+	harLog := har.HarLog
+	if harLog.Creator != (HarCreator{Name: "GoHarProxy", Version: "0.1"}) || harLog.Browser != nil {
+		t.Fatal("Unexpected creator: ", harLog.Creator, harLog.Browser)
+	}
+	entry := harLog.Entries[0]
+	if entry.ServerIpAddress != "10.0.0.1" || entry.Timings.Wait != 12 || entry.Response.HttpVersion != "HTTP/1.1" {
+		t.Fatal("Unexpected entry: ", entry)
+	}
+
+	if _, err := ParseHar(strings.NewReader(`{"something": "else"}`)); err == nil {
+		t.Fatal("Expected error parsing a document without a log")
+	}
+}
+
+func TestMergeAndFilterHarLogs(t *testing.T) {
+	start := time.Now()
+	first := &HarLog{
+		Pages	: []HarPage{{Id: "page_1"}},
+		Entries : []HarEntry{{PageRef: "page_1", StartedDateTime: start.Add(2 * time.Second), Request: &HarRequest{Url: "http://a/2"}}},
+	}
+	second := &HarLog{
+		Pages	: []HarPage{{Id: "page_1"}, {Id: "page_2"}},
+		Entries : []HarEntry{
+			{PageRef: "page_2", StartedDateTime: start, Request: &HarRequest{Url: "http://b/1"}},
+			{PageRef: "page_2", StartedDateTime: start.Add(3 * time.Second), Request: &HarRequest{Url: "http://b/3"}},
+		},
+	}
+
+	merged := MergeHarLogs(first, second)
+	urls := make([]string, 0)
+	for _, entry := range merged.Entries {
+		urls = append(urls, entry.Request.Url)
+	}
+	if !reflect.DeepEqual(urls, []string{"http://b/1", "http://a/2", "http://b/3"}) || len(merged.Pages) != 2 {
+		t.Fatal("Unexpected merged log: ", urls, merged.Pages)
+	}
+
+	filtered := merged.Filter(func(entry *HarEntry) bool {
+		return strings.HasPrefix(entry.Request.Url, "http://a/")
+	})
+	if len(filtered.Entries) != 1 || len(filtered.Pages) != 1 || filtered.Pages[0].Id != "page_1" {
+		t.Fatal("Unexpected filtered log: ", filtered)
+	}
+}
+
+func TestCustomFieldsRoundTrip(t *testing.T) {
+	entry := HarEntry{
+		Request  : &HarRequest{Method: "GET", Custom: map[string]interface{}{"_traceId": "abc"}},
+		Response : &HarResponse{Status: 200, Error: "none"},
+		Custom	 : map[string]interface{}{"_testName": "login", "_step": 2.0, "notCustom": true},
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "notCustom") || !strings.HasSuffix(string(data), `"_step":2,"_testName":"login"}`) {
+		t.Fatal("Unexpected custom fields in: ", string(data))
+	}
+
+	var parsed HarEntry
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed.Custom, map[string]interface{}{"_testName": "login", "_step": 2.0}) {
+		t.Fatal("Unexpected entry custom fields: ", parsed.Custom)
+	}
+	if parsed.Request.Custom["_traceId"] != "abc" || parsed.Response.Custom != nil || parsed.Response.Error != "none" {
+		t.Fatal("Unexpected custom fields: ", parsed.Request.Custom, parsed.Response.Custom)
+	}
+}
+
 func getTestSendRequest(method string, t *testing.T) (*http.Request, *HarRequest) {
 	data := url.Values{}
 	data.Set("name", "foo")
@@ -0,0 +1,164 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// HAR validation
+
+// The fields of each HAR 1.2 object, mapped to their type.
+// Required fields start with "!", arrays with "[]", and objects are named by their key in this table.
+// Like the HAR JSON schema, fields not listed here are allowed.
+var harSchema = map[string]map[string]string {
+	"har"		  : {"log": "!log"},
+	"log"		  : {"version": "!string", "creator": "!creator", "browser": "creator", "pages": "[]page",
+					 "entries": "![]entry", "comment": "string"},
+	"creator"	  : {"name": "!string", "version": "!string", "comment": "string"},
+	"page"		  : {"startedDateTime": "!date", "id": "!string", "title": "!string", "pageTimings": "!pageTimings",
+					 "comment": "string"},
+	"pageTimings" : {"onContentLoad": "optionalDuration", "onLoad": "optionalDuration", "comment": "string"},
+	"entry"		  : {"pageref": "string", "startedDateTime": "!date", "time": "!duration", "request": "!request",
+					 "response": "!response", "cache": "!cache", "timings": "!timings", "serverIPAddress": "string",
+					 "connection": "string", "comment": "string"},
+	"request"	  : {"method": "!string", "url": "!string", "httpVersion": "!string", "cookies": "![]cookie",
+					 "headers": "![]record", "queryString": "![]record", "postData": "postData",
+					 "headersSize": "!integer", "bodySize": "!integer", "comment": "string"},
+	"response"	  : {"status": "!integer", "statusText": "!string", "httpVersion": "!string", "cookies": "![]cookie",
+					 "headers": "![]record", "content": "!content", "redirectURL": "!string",
+					 "headersSize": "!integer", "bodySize": "!integer", "comment": "string"},
+	"cookie"	  : {"name": "!string", "value": "!string", "path": "string", "domain": "string", "expires": "date",
+					 "httpOnly": "boolean", "secure": "boolean", "comment": "string"},
+	"record"	  : {"name": "!string", "value": "!string", "comment": "string"},
+	"postData"	  : {"mimeType": "!string", "params": "[]param", "text": "string", "comment": "string"},
+	"param"		  : {"name": "!string", "value": "string", "fileName": "string", "contentType": "string",
+					 "comment": "string"},
+	"content"	  : {"size": "!integer", "compression": "integer", "mimeType": "!string", "text": "string",
+					 "encoding": "string", "comment": "string"},
+	"cache"		  : {"beforeRequest": "cacheState", "afterRequest": "cacheState", "comment": "string"},
+	"cacheState"  : {"expires": "string", "lastAccess": "!string", "eTag": "!string", "hitCount": "!integer",
+					 "comment": "string"},
+	"timings"	  : {"blocked": "optionalDuration", "dns": "optionalDuration", "connect": "optionalDuration",
+					 "send": "!duration", "wait": "!duration", "receive": "!duration", "ssl": "optionalDuration",
+					 "comment": "string"},
+}
+
+// ValidateHar checks a HAR document against the HAR 1.2 specification,
+// then checks it is still valid after being read into our types and written back.
+func ValidateHar(data []byte) error {
+	if err := validateHarJson(data); err != nil {
+		return err
+	}
+
+	var har Har
+	if err := json.Unmarshal(data, &har); err != nil {
+		return err
+	}
+	roundTripped, err := json.Marshal(&har)
+	if err != nil {
+		return err
+	}
+	if err := validateHarJson(roundTripped); err != nil {
+		return fmt.Errorf("Invalid after round trip: %v", err)
+	}
+	return nil
+}
+
+func validateHarJson(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return validateHarValue("har", "har", value)
+}
+
+func validateHarValue(path string, kind string, value interface{}) error {
+	switch kind {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%v: expected a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%v: expected a boolean", path)
+		}
+	case "date":
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v: expected a date", path)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, s); err != nil {
+			return fmt.Errorf("%v: expected an ISO 8601 date, got [%v]", path, s)
+		}
+	case "integer", "duration", "optionalDuration":
+		return validateHarNumber(path, kind, value)
+	default:
+		if strings.HasPrefix(kind, "[]") {
+			return validateHarArray(path, kind[len("[]"):], value)
+		}
+		return validateHarObject(path, kind, value)
+	}
+	return nil
+}
+
+func validateHarNumber(path string, kind string, value interface{}) error {
+	n, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("%v: expected a number", path)
+	}
+	switch {
+	case kind == "integer" && n != math.Trunc(n):
+		return fmt.Errorf("%v: expected an integer, got %v", path, n)
+	case kind == "duration" && n < 0:
+		return fmt.Errorf("%v: expected a duration of at least 0, got %v", path, n)
+	case kind == "optionalDuration" && n < -1:
+		return fmt.Errorf("%v: expected a duration of at least -1, got %v", path, n)
+	}
+	return nil
+}
+
+func validateHarArray(path string, kind string, value interface{}) error {
+	items, ok := value.([]interface{})
+	if !ok {
+		return fmt.Errorf("%v: expected an array", path)
+	}
+	for i, item := range items {
+		if err := validateHarValue(fmt.Sprintf("%v[%v]", path, i), kind, item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateHarObject(path string, kind string, value interface{}) error {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%v: expected an object", path)
+	}
+	fields := harSchema[kind]
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fieldKind := fields[name]
+		required := strings.HasPrefix(fieldKind, "!")
+		fieldValue, present := object[name]
+		if !present || fieldValue == nil {
+			if required {
+				return fmt.Errorf("%v: missing required field [%v]", path, name)
+			}
+			continue
+		}
+		if err := validateHarValue(path + "." + name, strings.TrimPrefix(fieldKind, "!"), fieldValue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,241 @@
+package goharproxy
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Writing entries to disk
+
+const (
+	// Each file is a HAR document, completed when the file is closed
+	HarFileFormatHar = "har"
+	// Each entry is written as a line of json as soon as it is captured
+	HarFileFormatNdjson = "ndjson"
+)
+
+// Where and how a proxy writes its entries to disk instead of keeping them in its HarLog
+type HarFileOptions struct {
+	// Directory the files are written to, named har-[port]-[start time]-[sequence].[format]
+	Dir string	`json:"dir"`
+
+	// HarFileFormatHar or HarFileFormatNdjson
+	Format string	`json:"format"`
+
+	// A new file is started once the current one has this many entries, this many bytes,
+	// or was started this long ago. Zero for no limit.
+	MaxEntries int				`json:"maxEntries,omitempty"`
+	MaxBytes   int64			`json:"maxBytes,omitempty"`
+	MaxAge     time.Duration	`json:"maxAge,omitempty"`
+
+	// Compress each file with gzip once it is complete, replacing it with a .gz file
+	Gzip bool	`json:"gzip"`
+}
+
+func (options HarFileOptions) validate() error {
+	if options.Dir == "" {
+		return errors.New("Missing HAR file directory")
+	}
+	if options.Format != HarFileFormatHar && options.Format != HarFileFormatNdjson {
+		return fmt.Errorf("Invalid HAR file format [%v]", options.Format)
+	}
+	if options.MaxEntries < 0 || options.MaxBytes < 0 || options.MaxAge < 0 {
+		return errors.New("HAR file limits must not be negative")
+	}
+	return os.MkdirAll(options.Dir, 0755)
+}
+
+// Resolves dir, the value of the option name, under baseDir. API clients only name directories relative to
+// the base directory the operator configured, so absolute paths and ".." are refused, as is any dir without a base.
+func resolveHarDir(baseDir string, name string, dir string) (string, error) {
+	if baseDir == "" {
+		return "", fmt.Errorf("Option %v requires the server to have a HAR base directory", name)
+	}
+	if filepath.IsAbs(dir) || filepath.VolumeName(dir) != "" {
+		return "", fmt.Errorf("Invalid %v [%v], expected a path relative to the HAR base directory", name, dir)
+	}
+	for _, segment := range strings.Split(filepath.ToSlash(dir), "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("Invalid %v [%v], .. is not allowed", name, dir)
+		}
+	}
+	return filepath.Join(baseDir, dir), nil
+}
+
+// Writes entries to files, opening a file on the first entry after the previous one was completed
+type harFileWriter struct {
+	options HarFileOptions
+	port    int
+	logger  *slog.Logger
+
+	lock     sync.Mutex
+	file     *os.File
+	entries  int
+	bytes    int64
+	sequence int
+	timer    *time.Timer
+	closed   bool
+}
+
+func newHarFileWriter(options HarFileOptions, port int, logger *slog.Logger) *harFileWriter {
+	return &harFileWriter{options : options, port : port, logger : logger}
+}
+
+func (w *harFileWriter) write(harEntry HarEntry) error {
+	data, err := json.Marshal(harEntry)
+	if err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return errors.New("HAR file writer is closed")
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if w.options.Format == HarFileFormatNdjson {
+		err = w.writeBytes(data, []byte("\n"))
+	} else if w.entries == 0 {
+		err = w.writeBytes(data)
+	} else {
+		err = w.writeBytes([]byte(","), data)
+	}
+	if err != nil {
+		return err
+	}
+	w.entries++
+
+	if (w.options.MaxEntries > 0 && w.entries >= w.options.MaxEntries) ||
+		(w.options.MaxBytes > 0 && w.bytes >= w.options.MaxBytes) {
+		return w.complete()
+	}
+	return nil
+}
+
+func (w *harFileWriter) writeBytes(data ...[]byte) error {
+	for _, b := range data {
+		n, err := w.file.Write(b)
+		w.bytes += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *harFileWriter) open() error {
+	w.sequence++
+	name := fmt.Sprintf("har-%v-%v-%04d.%v", w.port, time.Now().Format("20060102-150405"), w.sequence, w.options.Format)
+	file, err := os.Create(filepath.Join(w.options.Dir, name))
+	if err != nil {
+		return err
+	}
+	w.file = file
+	w.entries = 0
+	w.bytes = 0
+
+	if w.options.Format == HarFileFormatHar {
+		if err := w.writeBytes([]byte(harFileHead())); err != nil {
+			return err
+		}
+	}
+	if w.options.MaxAge > 0 {
+		w.timer = time.AfterFunc(w.options.MaxAge, func() {
+			w.lock.Lock()
+			defer w.lock.Unlock()
+			if w.file == file {
+				if err := w.complete(); err != nil {
+					w.logger.Error("Error completing HAR file", "file", file.Name(), "err", err)
+				}
+			}
+		})
+	}
+	return nil
+}
+
+// Everything a HAR document has before its first entry
+func harFileHead() string {
+	head, _ := json.Marshal(Har{HarLog: *newHarLog()})
+	return string(head[:len(head)-len(harFileTail)])
+}
+
+// Everything a HAR document has after its last entry
+const harFileTail = "]}}"
+
+// Finishes the current file, if there is one
+func (w *harFileWriter) complete() error {
+	if w.file == nil {
+		return nil
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	var err error
+	if w.options.Format == HarFileFormatHar {
+		err = w.writeBytes([]byte(harFileTail))
+	}
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	name := w.file.Name()
+	w.file = nil
+	if err == nil && w.options.Gzip {
+		err = gzipFile(name)
+	}
+	return err
+}
+
+// Finishes the current file, the next entry starts a new one
+func (w *harFileWriter) rotate() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.complete()
+}
+
+// Finishes the current file, entries written afterwards are dropped
+func (w *harFileWriter) close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	return w.complete()
+}
+
+// Replaces a file with a gzip compressed copy named with a .gz suffix
+func gzipFile(name string) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(name + ".gz")
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if closeErr := gz.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	return os.Remove(name)
+}
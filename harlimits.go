@@ -0,0 +1,129 @@
+package goharproxy
+
+import (
+	"fmt"
+)
+
+// Limits on the entries a proxy keeps
+
+const (
+	// Evicts the oldest entries to make room for new ones
+	EvictDropOldest = "dropOldest"
+	// Drops new entries which do not fit, keeping those already in the log
+	EvictDropNewest = "dropNewest"
+	// Stops capturing entries once one does not fit, until the entries are cleared
+	EvictStop = "stop"
+)
+
+// Adds an entry to our log, keeping it within our limits
+func (proxy *HarProxy) recordEntry(harEntry HarEntry) {
+	size := entryBodyBytes(&harEntry)
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+
+	if proxy.stoppedCapture {
+		proxy.dropEntry()
+		return
+	}
+	if !proxy.withinLimits(size) {
+		switch proxy.EvictionPolicy {
+		case EvictDropNewest:
+			proxy.dropEntry()
+			return
+		case EvictStop:
+			proxy.logger().Warn("Reached the proxy's limits, no longer capturing entries")
+			proxy.stoppedCapture = true
+			proxy.dropEntry()
+			return
+		default:
+			if proxy.MaxBodyBytes > 0 && size > proxy.MaxBodyBytes {
+				proxy.dropEntry()
+				return
+			}
+			for len(proxy.HarLog.Entries) > 0 && !proxy.withinLimits(size) {
+				proxy.bodyBytes -= entryBodyBytes(&proxy.HarLog.Entries[0])
+				// Let the evicted entry be collected before the slice is reallocated
+				proxy.HarLog.Entries[0] = HarEntry{}
+				proxy.HarLog.Entries = proxy.HarLog.Entries[1:]
+				proxy.dropEntry()
+			}
+		}
+	}
+	proxy.HarLog.addEntry(harEntry)
+	proxy.logger().Debug("Added entry", "url", proxy.logRawUrl(harEntry.Request.Url))
+	proxy.bodyBytes += size
+}
+
+func (proxy *HarProxy) dropEntry() {
+	proxy.droppedEntries++
+	proxy.metrics.dropEntry()
+}
+
+// Whether another entry with size bytes of bodies fits in our log
+func (proxy *HarProxy) withinLimits(size int64) bool {
+	return (proxy.MaxEntries <= 0 || len(proxy.HarLog.Entries) < proxy.MaxEntries) &&
+		(proxy.MaxBodyBytes <= 0 || proxy.bodyBytes + size <= proxy.MaxBodyBytes)
+}
+
+// The bytes of request and response bodies captured in an entry
+func entryBodyBytes(harEntry *HarEntry) int64 {
+	var size int64
+	if harEntry.Request != nil && harEntry.Request.PostData != nil {
+		size += int64(len(harEntry.Request.PostData.Text))
+	}
+	if harEntry.Response != nil && harEntry.Response.Content != nil {
+		size += int64(len(harEntry.Response.Content.Text))
+	}
+	return size
+}
+
+// The number of entries dropped to stay within our limits since the entries were last cleared
+func (proxy *HarProxy) DroppedEntries() int64 {
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	return proxy.droppedEntries
+}
+
+func (proxy *HarProxy) entryCount() int {
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	return len(proxy.HarLog.Entries)
+}
+
+// The HAR document holding a copy of our log
+func (proxy *HarProxy) Har() *Har {
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	return proxy.har()
+}
+
+// Returns our HAR and clears its entries
+func (proxy *HarProxy) takeHar() *Har {
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	har := proxy.har()
+	proxy.clearEntries()
+	return har
+}
+
+func (proxy *HarProxy) har() *Har {
+	harLog := *proxy.HarLog
+	harLog.Pages = append([]HarPage(nil), proxy.HarLog.Pages...)
+	harLog.Entries = append([]HarEntry(nil), proxy.HarLog.Entries...)
+	if proxy.droppedEntries > 0 {
+		dropped := fmt.Sprintf("Dropped %v entries to stay within the proxy's limits", proxy.droppedEntries)
+		if harLog.Comment != "" {
+			dropped = harLog.Comment + ". " + dropped
+		}
+		harLog.Comment = dropped
+	}
+	return &Har{HarLog: harLog}
+}
+
+func (proxy *HarProxy) clearEntries() {
+	proxy.HarLog.Entries = nil
+	proxy.clearPages()
+	proxy.bodyBytes = 0
+	proxy.droppedEntries = 0
+	proxy.stoppedCapture = false
+}
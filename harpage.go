@@ -0,0 +1,61 @@
+package goharproxy
+
+import (
+	"strconv"
+	"time"
+)
+
+// Pages
+
+// Starts a new page in our log, the entries of requests made from now on refer to it.
+// An empty id is named after the number of pages, such as "page_2".
+func (proxy *HarProxy) NewPage(id string, title string) string {
+	id, _ = proxy.NewPageWithCustom(id, title, nil)
+	return id
+}
+
+// Starts a new page as NewPage does, with custom fields named with a leading "_"
+func (proxy *HarProxy) NewPageWithCustom(id string, title string, custom map[string]interface{}) (string, error) {
+	copied, err := copyCustom(custom, "page custom field")
+	if err != nil {
+		return "", err
+	}
+	if len(copied) == 0 {
+		copied = nil
+	}
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	if id == "" {
+		id = "page_" + strconv.Itoa(len(proxy.HarLog.Pages) + 1)
+	}
+	if title == "" {
+		title = id
+	}
+	proxy.HarLog.Pages = append(proxy.HarLog.Pages, HarPage{
+		Id				: id,
+		StartedDateTime : time.Now(),
+		Title			: title,
+		PageTimings		: HarPageTimings{OnContentLoad: -1, OnLoad: -1},
+		Custom			: copied,
+	})
+	proxy.currentPage = id
+	return id, nil
+}
+
+// The page new entries refer to, empty before the first page
+func (proxy *HarProxy) currentPageRef() string {
+	proxy.harLogLock.Lock()
+	defer proxy.harLogLock.Unlock()
+	return proxy.currentPage
+}
+
+// Keeps only the current page, which entries still to come refer to
+func (proxy *HarProxy) clearPages() {
+	var pages []HarPage
+	for _, page := range proxy.HarLog.Pages {
+		if page.Id == proxy.currentPage {
+			pages = append(pages, page)
+		}
+	}
+	proxy.HarLog.Pages = pages
+}
@@ -15,6 +15,24 @@ import (
 	"bytes"
 	"io/ioutil"
 	"strings"
+	"bufio"
+	"encoding/base64"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"time"
+	"os"
+	"path/filepath"
+	"sort"
+	"compress/gzip"
+	"reflect"
+	"context"
+	"sync/atomic"
+	"log/slog"
+	"sync"
 )
 
 var acceptAllCerts = &tls.Config{InsecureSkipVerify: true}
@@ -23,6 +41,7 @@ var srv = httptest.NewServer(nil)
 func init() {
 	http.DefaultServeMux.Handle("/bobo", ConstantHanlder("bobo"))
 	http.DefaultServeMux.Handle("/query", QueryHandler{})
+	http.DefaultServeMux.Handle("/chunked", ChunkedHandler("chunked body"))
 	http.DefaultServeMux.Handle("/", ConstantHanlder("google"))
 }
 
@@ -35,6 +54,14 @@ func (QueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, req.Form.Get("result"))
 }
 
+// Flushes before writing, so the response has no content length
+type ChunkedHandler string
+
+func (h ChunkedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.(http.Flusher).Flush()
+	io.WriteString(w, string(h))
+}
+
 type ConstantHanlder string
 
 func (h ConstantHanlder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -79,10 +106,869 @@ func TestHttpHarProxyGetHostEntries(t *testing.T) {
 	}
 }
 
+func TestHttpHarProxyStreamEntries(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+
+	streamServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		streamHarEntries(harProxy, w, r)
+	}))
+	defer streamServer.Close()
+
+	resp, err := http.Get(streamServer.URL)
+	testResp(t, resp, err)
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatal("Expected ndjson content type but got: ", resp.Header.Get("Content-Type"))
+	}
+
+	_, err = client.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var harEntry *HarEntry = new(HarEntry)
+	if err := json.NewDecoder(resp.Body).Decode(harEntry); err != nil {
+		t.Fatal(err)
+	}
+	if harEntry.Request.Url != srv.URL + "/bobo" {
+		t.Fatal("Expected streamed entry for ", srv.URL + "/bobo", " but got: ", harEntry.Request.Url)
+	}
+}
+
+func TestHttpHarProxyWebSocketMessages(t *testing.T) {
+	wsServer := httptest.NewServer(http.HandlerFunc(webSocketEchoHandler))
+	defer wsServer.Close()
+	wsUrl, _ := url.Parse(wsServer.URL)
+
+	for _, test := range []struct {
+		connect     bool
+		maxMessages int
+	}{{false, 0}, {true, 0}, {false, 1}} {
+		connect := test.connect
+		_, harProxy, s := oneShotProxy()
+		if test.maxMessages > 0 {
+			harProxy.WebSocketMaxMessages = test.maxMessages
+		}
+		entries := harProxy.Subscribe()
+		conn, err := net.Dial("tcp", s.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader := bufio.NewReader(conn)
+		path := "http://" + wsUrl.Host + "/ws"
+		if connect {
+			fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", wsUrl.Host, wsUrl.Host)
+			if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatal("Failed connecting through proxy: ", err)
+			}
+			path = "/ws"
+		}
+		fmt.Fprintf(conn, "GET %v HTTP/1.1\r\nHost: %v\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", path, wsUrl.Host)
+		resp, err := http.ReadResponse(reader, nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatal("Websocket handshake failed: ", err)
+		}
+
+		mask := []byte{1, 2, 3, 4}
+		payload := []byte("hello")
+		frame := append([]byte{0x81, 0x80 | byte(len(payload))}, mask...)
+		for i, b := range payload {
+			frame = append(frame, b ^ mask[i % 4])
+		}
+		conn.Write(frame)
+		echo := make([]byte, 2 + len(payload))
+		if _, err := io.ReadFull(reader, echo); err != nil || string(echo[2:]) != "hello" {
+			t.Fatal("Did not get websocket echo: ", err)
+		}
+		conn.Close()
+
+		harEntry := <-entries
+		messages := harEntry.WebSocketMessages
+		if test.maxMessages > 0 {
+			// The messages beyond the limit are dropped and counted
+			if len(messages) != 1 || messages[0].Type != "send" || harEntry.Custom["_webSocketDroppedMessages"] != int64(1) {
+				t.Fatal("Expected one message kept and one dropped, got: ", messages, harEntry.Custom)
+			}
+			s.Close()
+			continue
+		}
+		if len(messages) != 2 || messages[0].Type != "send" || messages[1].Type != "receive" ||
+			messages[0].Data != "hello" || messages[1].Data != "hello" || messages[0].Opcode != 1 {
+			t.Fatal("Did not record websocket messages, got: ", messages)
+		}
+		s.Close()
+	}
+}
+
+func TestHttpsHarProxyHttp2(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Accept-Encoding", r.Header.Get("Accept-Encoding"))
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+
+	ca, roots := newTestCA(t)
+	harProxy := NewHarProxy()
+	harProxy.MitmCA = ca
+	harProxy.Http2 = true
+	harProxy.upstreamTransport.TLSClientConfig = acceptAllCerts
+	entries := harProxy.Subscribe()
+	s := httptest.NewServer(harProxy)
+	defer s.Close()
+
+	proxyUrl, _ := url.Parse(s.URL)
+	tr := &http.Transport{Proxy: http.ProxyURL(proxyUrl), TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true,
+		DisableCompression: true}
+	resp, err := (&http.Client{Transport: tr}).Get(upstream.URL)
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Proto != "HTTP/2.0" || string(body) != "HTTP/2.0" {
+		t.Fatal("Expected HTTP/2.0 on both sides but got: ", resp.Proto, string(body))
+	}
+	// Requests go upstream with the headers the client sent, without one asking for compression
+	if encoding := resp.Header.Get("X-Accept-Encoding"); encoding != "" {
+		t.Fatal("Expected no Accept-Encoding to be added upstream, got: ", encoding)
+	}
+
+	harEntry := <-entries
+	if harEntry.Request.HttpVersion != "HTTP/2.0" || harEntry.Response.HttpVersion != "HTTP/2.0" {
+		t.Fatal("Expected HTTP/2.0 entry but got: ", harEntry.Request.HttpVersion, harEntry.Response.HttpVersion)
+	}
+	if harEntry.Connection == "" {
+		t.Fatal("Expected entry to have a connection id")
+	}
+}
+
+func newTestCA(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber		  : big.NewInt(1),
+		Subject				  : pkix.Name{CommonName: "goharproxy test CA"},
+		NotBefore			  : time.Now().Add(-time.Hour),
+		NotAfter			  : time.Now().Add(time.Hour),
+		KeyUsage			  : x509.KeyUsageCertSign,
+		IsCA				  : true,
+		BasicConstraintsValid : true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, roots
+}
+
+func TestHttpHarProxyChunkedBodySize(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	entries := harProxy.Subscribe()
+
+	resp, err := client.Get(srv.URL + "/chunked")
+	testResp(t, resp, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	harEntry := <-entries
+	if harEntry.Response.BodySize != int64(len("chunked body")) {
+		t.Fatal("Expected body size of chunked response to be ", len("chunked body"), " but got: ", harEntry.Response.BodySize)
+	}
+	if harEntry.Request.BodySize != 0 || harEntry.Response.HeadersSize <= 0 || harEntry.Request.HeadersSize <= 0 {
+		t.Fatal("Unexpected sizes in entry: ", harEntry.Request, harEntry.Response)
+	}
+}
+
+func TestHttpHarProxyWireHeadersSize(t *testing.T) {
+	rawResponse := "HTTP/1.1 200 OK\r\ncontent-type: text/plain\r\nX-Folded: a\r\n  b\r\nSet-Cookie: a=1\r\nSet-Cookie: b=2\r\nContent-Length: 5\r\n\r\n"
+	upstream := rawUpstream(t, rawResponse + "hello")
+	defer upstream.Close()
+	harProxy := NewHarProxy()
+	harProxy.Start()
+	defer harProxy.Stop()
+	entries := harProxy.Subscribe()
+
+	rawRequest := "GET http://" + upstream.Addr().String() + "/raw?q=1 HTTP/1.1\r\nhost: " + upstream.Addr().String() +
+		"\r\nX-b: 1\r\nx-a:  2\r\nX-B: 3\r\nConnection: close\r\n\r\n"
+	resp := rawRequestThrough(t, harProxy.Port, rawRequest)
+	if !strings.HasSuffix(resp, "hello") {
+		t.Fatal("Unexpected response: ", resp)
+	}
+
+	harEntry := <-entries
+	if harEntry.Request.HeadersSize != int64(len(rawRequest)) {
+		t.Fatal("Expected request headers size ", len(rawRequest), " but got: ", harEntry.Request.HeadersSize)
+	}
+	if harEntry.Response.HeadersSize != int64(len(rawResponse)) || harEntry.Response.BodySize != 5 {
+		t.Fatal("Expected response headers size ", len(rawResponse), " and body size 5 but got: ", harEntry.Response.HeadersSize, " ", harEntry.Response.BodySize)
+	}
+}
+
+func TestHttpHarProxyWireHeaderOrder(t *testing.T) {
+	upstream := rawUpstream(t, "HTTP/1.1 200 OK\r\nx-Zeta: z\r\nSet-Cookie: a=1\r\ncontent-length: 2\r\nSet-Cookie: b=2\r\nX-Folded: a\r\n  b\r\n\r\nok")
+	defer upstream.Close()
+	harProxy := NewHarProxy()
+	harProxy.Start()
+	defer harProxy.Stop()
+	entries := harProxy.Subscribe()
+
+	host := upstream.Addr().String()
+	rawRequestThrough(t, harProxy.Port, "GET http://" + host + "/raw HTTP/1.1\r\nhost: " + host +
+		"\r\nX-b: 1\r\nx-a: 2\r\nProxy-Authorization: Basic dTpw\r\nX-B: 3\r\nConnection: close\r\n\r\n")
+
+	harEntry := <-entries
+	expectedRequest := []HarNameValuePair{{"host", host}, {"X-b", "1"}, {"x-a", "2"}, {"X-B", "3"}, {"Connection", "close"}}
+	if !reflect.DeepEqual(harEntry.Request.Headers, expectedRequest) {
+		t.Fatal("Expected request headers in wire order and casing: ", expectedRequest, " but got: ", harEntry.Request.Headers)
+	}
+	expectedResponse := []HarNameValuePair{{"x-Zeta", "z"}, {"Set-Cookie", "a=1"}, {"content-length", "2"}, {"Set-Cookie", "b=2"}, {"X-Folded", "a b"}}
+	if !reflect.DeepEqual(harEntry.Response.Headers, expectedResponse) {
+		t.Fatal("Expected response headers in wire order and casing: ", expectedResponse, " but got: ", harEntry.Response.Headers)
+	}
+}
+
+func TestHttpHarProxyWireHeadersKeepAlive(t *testing.T) {
+	// Bodies without a trailing newline, looking like the start line of the message after them
+	upstream := rawUpstream(t, "HTTP/1.1 200 OK\r\nContent-Length: 12\r\n\r\nHTTP/1.1 200",
+		"HTTP/1.1 200 OK\r\nx-Second: 2\r\nContent-Length: 2\r\n\r\nok")
+	defer upstream.Close()
+	harProxy := NewHarProxy()
+	harProxy.Start()
+	defer harProxy.Stop()
+	entries := harProxy.Subscribe()
+
+	host := upstream.Addr().String()
+	body := "GET http://" + host + "/second HTTP/1.1"
+	first := "POST http://" + host + "/first HTTP/1.1\r\nHost: " + host + "\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	second := "GET http://" + host + "/second HTTP/1.1\r\nhost: " + host + "\r\nx-Second: 2\r\nConnection: close\r\n\r\n"
+	rawRequestThrough(t, harProxy.Port, first + second)
+
+	<-entries
+	harEntry := <-entries
+	expectedRequest := []HarNameValuePair{{"host", host}, {"x-Second", "2"}, {"Connection", "close"}}
+	if !reflect.DeepEqual(harEntry.Request.Headers, expectedRequest) || harEntry.Request.HeadersSize != int64(len(second)) {
+		t.Fatal("Expected the second request's wire headers: ", expectedRequest, " but got: ", harEntry.Request.Headers, " ", harEntry.Request.HeadersSize)
+	}
+	expectedResponse := []HarNameValuePair{{"x-Second", "2"}, {"Content-Length", "2"}}
+	if !reflect.DeepEqual(harEntry.Response.Headers, expectedResponse) {
+		t.Fatal("Expected the second response's wire headers: ", expectedResponse, " but got: ", harEntry.Response.Headers)
+	}
+}
+
+// Listens for one connection, answering its requests with rawResponses in turn
+func rawUpstream(t *testing.T, rawResponses ...string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for _, rawResponse := range rawResponses {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			ioutil.ReadAll(req.Body)
+			conn.Write([]byte(rawResponse))
+		}
+	}()
+	return l
+}
+
+// Sends rawRequest to the proxy on port, returning all it answers
+func rawRequestThrough(t *testing.T, port int, rawRequest string) string {
+	conn, err := net.Dial("tcp", "127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(rawRequest))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, _ := ioutil.ReadAll(conn)
+	return string(resp)
+}
+
+func TestHttpHarProxyCaptureContent(t *testing.T) {
+	for _, capture := range []bool{false, true} {
+		client, harProxy, s := oneShotProxy()
+		harProxy.CaptureContent = capture
+		entries := harProxy.Subscribe()
+
+		resp, err := client.Post(srv.URL + "/query?result=bla", "text/plain", strings.NewReader("sent"))
+		testResp(t, resp, err)
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		harEntry := <-entries
+		s.Close()
+
+		if capture && (harEntry.Response.Content.Text != "bla" || harEntry.Request.PostData == nil || harEntry.Request.PostData.Text != "sent") {
+			t.Fatal("Expected the captured bodies, got: ", harEntry.Response.Content, harEntry.Request.PostData)
+		}
+		if !capture && (harEntry.Response.Content.Text != "" || harEntry.Request.PostData != nil || harEntry.Response.Content.Size != 3) {
+			t.Fatal("Expected bodies not to be captured, got: ", harEntry.Response.Content, harEntry.Request.PostData)
+		}
+	}
+}
+
+func TestHttpHarProxyCaptureStreamedContent(t *testing.T) {
+	release := make(chan bool)
+	streaming := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-time.After(5 * time.Second):
+		}
+		io.WriteString(w, "second")
+	}))
+	defer streaming.Close()
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.CaptureContent = true
+	harProxy.MaxBodyBytes = 8
+	entries := harProxy.Subscribe()
+
+	resp, err := client.Get(streaming.URL)
+	testResp(t, resp, err)
+	// The first chunk reaches the client before the response is complete
+	first := make([]byte, len("first"))
+	read := make(chan error)
+	go func() {
+		_, err := io.ReadFull(resp.Body, first)
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		if err != nil || string(first) != "first" {
+			t.Fatal("Unexpected first chunk: ", string(first), err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the response to be streamed to the client")
+	}
+	close(release)
+	rest, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(rest) != "second" {
+		t.Fatal("Unexpected rest of the response: ", string(rest))
+	}
+
+	// Kept up to maxBodyBytes
+	harEntry := <-entries
+	if harEntry.Response.Content.Text != "firstsec" || harEntry.Response.Content.Size != int64(len("firstsecond")) {
+		t.Fatal("Expected the captured start of the streamed body, got: ", harEntry.Response.Content)
+	}
+}
+
+func TestHttpHarProxyUpstream(t *testing.T) {
+	// Answers plain requests itself, and tunnels CONNECTs from clients with its credentials
+	var connects, requests int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "Basic " + base64.StdEncoding.EncodeToString([]byte("bob:pass")) {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		if r.Method != "CONNECT" {
+			atomic.AddInt64(&requests, 1)
+			io.WriteString(w, "upstream " + r.URL.String())
+			return
+		}
+		atomic.AddInt64(&connects, 1)
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		client, _, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(client, "HTTP/1.1 200 OK\r\n\r\n")
+		go io.Copy(target, client)
+		io.Copy(client, target)
+		client.Close()
+		target.Close()
+	}))
+	defer upstream.Close()
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	if err := applyProxyParams(harProxy, url.Values{"upstream": {"ftp://" + upstream.Listener.Addr().String()}}, ""); err == nil {
+		t.Fatal("Expected an upstream which isn't an http proxy to be refused")
+	}
+	upstreamUrl := "http://bob:pass@" + upstream.Listener.Addr().String()
+	if err := applyProxyParams(harProxy, url.Values{"upstream": {upstreamUrl}}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if info := harProxy.Info(); info.UpstreamHttp != "http://" + upstream.Listener.Addr().String() {
+		t.Fatal("Expected the upstream without its credentials, got: ", info.UpstreamHttp)
+	}
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream " + srv.URL + "/bobo" || atomic.LoadInt64(&requests) != 1 {
+		t.Fatal("Expected the request to be answered by the upstream, got: ", string(body))
+	}
+
+	// Tunnels go through the upstream too
+	tunnel, err := net.Dial("tcp", s.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	fmt.Fprintf(tunnel, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	reader := bufio.NewReader(tunnel)
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to open: ", err)
+	}
+	fmt.Fprintf(tunnel, "GET /bobo HTTP/1.1\r\nHost: %v\r\n\r\n", host)
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected a response through the tunnel: ", err)
+	}
+	if atomic.LoadInt64(&connects) != 1 {
+		t.Fatal("Expected the tunnel to go through the upstream")
+	}
+}
+
+func TestHttpHarProxyValidHar(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	entries := harProxy.Subscribe()
+
+	resp, err := client.PostForm(srv.URL + "/bobo?a=1&b=2", url.Values{"name": {"foo"}})
+	testResp(t, resp, err)
+	resp.Body.Close()
+	<-entries
+	resp, err = client.Get(srv.URL + "/chunked")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	<-entries
+
+	data, err := ioutil.ReadAll(harProxy.NewHarReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateHar(data); err != nil {
+		t.Fatal("Expected a valid har but got: ", err)
+	}
+
+	var har Har
+	if err := json.Unmarshal(data, &har); err != nil {
+		t.Fatal(err)
+	}
+	roundTripped, _ := json.Marshal(&har)
+	if !bytes.Equal(bytes.TrimSpace(data), roundTripped) {
+		t.Fatal("Expected har to round trip unchanged, got: ", string(roundTripped))
+	}
+}
+
+func TestHttpHarProxyAnnotations(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	entries := harProxy.Subscribe()
+
+	if err := harProxy.SetAnnotations(map[string]interface{}{"testName": "login"}); err == nil {
+		t.Fatal("Expected error setting an annotation without a leading _")
+	}
+	harProxy.SetAnnotations(map[string]interface{}{"_testName": "login"})
+	harProxy.AddEntryInterceptor(func(entry *HarEntry) {
+		entry.Custom["_rule"] = entry.Request.Method
+	})
+
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+
+	harEntry := <-entries
+	if harEntry.Custom["_testName"] != "login" || harEntry.Custom["_rule"] != "GET" {
+		t.Fatal("Unexpected custom fields: ", harEntry.Custom)
+	}
+	if _, ok := harProxy.Annotations()["_rule"]; ok {
+		t.Fatal("Interceptor changed the proxy annotations")
+	}
+
+	// Interceptors can add fields to entries without annotations
+	harProxy.SetAnnotations(nil)
+	resp, err = client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	if harEntry := <-entries; harEntry.Custom["_rule"] != "GET" || len(harEntry.Custom) != 1 {
+		t.Fatal("Unexpected custom fields: ", harEntry.Custom)
+	}
+}
+
+func TestHttpHarProxyHarFile(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	dir, _ := ioutil.TempDir("", "harfile")
+	defer os.RemoveAll(dir)
+	harProxy.HarFile = &HarFileOptions{Dir: dir, Format: HarFileFormatHar, MaxEntries: 2, Gzip: true}
+	entries := harProxy.Subscribe()
+
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		resp.Body.Close()
+		<-entries
+	}
+	if len(harProxy.Har().HarLog.Entries) != 0 {
+		t.Fatal("Expected entries to be written to disk instead of memory")
+	}
+	harProxy.RotateHarFile()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har.gz"))
+	sort.Strings(files)
+	if len(files) != 2 {
+		t.Fatal("Expected 2 compressed HAR files, got: ", files)
+	}
+	for i, expectedEntries := range []int{2, 1} {
+		f, _ := os.Open(files[i])
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(gz)
+		f.Close()
+		if err := ValidateHar(data); err != nil {
+			t.Fatal("Invalid HAR file ", files[i], ": ", err)
+		}
+		har, _ := ParseHar(bytes.NewReader(data))
+		if len(har.HarLog.Entries) != expectedEntries {
+			t.Fatal("Expected ", expectedEntries, " entries in ", files[i], " got: ", len(har.HarLog.Entries))
+		}
+	}
+}
+
+func TestHttpHarProxyNdjsonFile(t *testing.T) {
+	client, harProxy, s := oneShotProxy()
+	defer s.Close()
+	dir, _ := ioutil.TempDir("", "harfile")
+	defer os.RemoveAll(dir)
+	harProxy.HarFile = &HarFileOptions{Dir: dir, Format: HarFileFormatNdjson}
+	entries := harProxy.Subscribe()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(srv.URL + "/bobo")
+		testResp(t, resp, err)
+		resp.Body.Close()
+		<-entries
+	}
+
+	// Entries are on disk as they are captured, before the file is complete
+	files, _ := filepath.Glob(filepath.Join(dir, "*.ndjson"))
+	if len(files) != 1 {
+		t.Fatal("Expected a single ndjson file, got: ", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatal("Expected 2 entries in ndjson file, got: ", string(data))
+	}
+	var harEntry HarEntry
+	if err := json.Unmarshal([]byte(lines[1]), &harEntry); err != nil || harEntry.Request.Url != srv.URL + "/bobo" {
+		t.Fatal("Unexpected entry in ndjson file: ", lines[1], err)
+	}
+}
+
+func TestHarProxyEvictionPolicies(t *testing.T) {
+	newEntry := func(url string, body string) HarEntry {
+		return HarEntry{
+			Request  : &HarRequest{Url: url},
+			Response : &HarResponse{Content: &HarContent{Text: body}},
+		}
+	}
+	urls := func(harProxy *HarProxy) []string {
+		urls := make([]string, 0)
+		for _, entry := range harProxy.Har().HarLog.Entries {
+			urls = append(urls, entry.Request.Url)
+		}
+		return urls
+	}
+
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{EvictDropOldest, []string{"http://b", "http://c", "http://d"}},
+		{EvictDropNewest, []string{"http://a", "http://b", "http://d"}},
+		{EvictStop, []string{"http://a", "http://b"}},
+	}
+	for _, test := range tests {
+		harProxy := NewHarProxy()
+		harProxy.MaxEntries = 3
+		harProxy.MaxBodyBytes = 10
+		harProxy.EvictionPolicy = test.policy
+		harProxy.recordEntry(newEntry("http://a", "1234"))
+		harProxy.recordEntry(newEntry("http://b", "1234"))
+		harProxy.recordEntry(newEntry("http://c", "12345"))
+		harProxy.recordEntry(newEntry("http://d", "1"))
+
+		if !reflect.DeepEqual(urls(harProxy), test.expected) {
+			t.Fatal("Unexpected entries with policy ", test.policy, ": ", urls(harProxy))
+		}
+		har := harProxy.takeHar()
+		dropped := 4 - int64(len(test.expected))
+		if har.HarLog.Comment != fmt.Sprintf("Dropped %v entries to stay within the proxy's limits", dropped) {
+			t.Fatal("Unexpected comment with policy ", test.policy, ": ", har.HarLog.Comment)
+		}
+		if harProxy.DroppedEntries() != 0 || len(harProxy.Har().HarLog.Entries) != 0 {
+			t.Fatal("Expected entries and dropped count to be cleared")
+		}
+		close(harProxy.entryChannel)
+	}
+}
+
+func TestHttpHarProxyAuth(t *testing.T) {
+	_, harProxy, s := oneShotProxy()
+	defer s.Close()
+	harProxy.SetProxyCredentials(map[string]string{"alice": "secret"})
+	harProxy.RecordProxyUser = true
+	entries := harProxy.Subscribe()
+
+	proxyUrl, _ := url.Parse(s.URL)
+	resp, err := newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusProxyAuthRequired || resp.Header.Get("Proxy-Authenticate") == "" {
+		t.Fatal("Expected proxy authentication to be required, got: ", resp.Status)
+	}
+	if _, err := newProxyHttpTestClient(proxyUrl).Get("https://127.0.0.1:1/"); err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+		t.Fatal("Expected CONNECT to require proxy authentication, got: ", err)
+	}
+
+	proxyUrl.User = url.UserPassword("alice", "secret")
+	resp, err = newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+
+	harEntry := <-entries
+	if harEntry.Custom["_proxyUser"] != "alice" {
+		t.Fatal("Expected entry to record the proxy user, got: ", harEntry.Custom)
+	}
+	for _, header := range harEntry.Request.Headers {
+		if header.Name == "Proxy-Authorization" {
+			t.Fatal("Proxy credentials were recorded in the HAR")
+		}
+	}
+}
+
+// Answers a websocket handshake and echoes a single short frame back unmasked
+func TestHarProxyShutdown(t *testing.T) {
+	release := make(chan bool)
+	slowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "done")
+	}))
+	defer slowServer.Close()
+	dir, _ := ioutil.TempDir("", "shutdown")
+	defer os.RemoveAll(dir)
+
+	harProxy := NewHarProxy()
+	harProxy.HarFile = &HarFileOptions{Dir: dir, Format: HarFileFormatHar}
+	harProxy.Start()
+	proxyUrl, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(harProxy.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+
+	// An in-flight request finishing before the deadline is answered and recorded
+	result := make(chan error)
+	go func() {
+		resp, err := client.Get(slowServer.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	for atomic.LoadInt64(&harProxy.requestsInProcess) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	shutdown := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+		defer cancel()
+		shutdown <- harProxy.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	if err := <-result; err != nil {
+		t.Fatal("Expected the in-flight request to finish: ", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := net.Dial("tcp", proxyUrl.Host); err == nil {
+		t.Fatal("Expected the proxy to stop accepting connections")
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 1 {
+		t.Fatal("Expected a single HAR file, got: ", files)
+	}
+	data, _ := ioutil.ReadFile(files[0])
+	har, err := ParseHar(bytes.NewReader(data))
+	if err != nil || len(har.HarLog.Entries) != 1 {
+		t.Fatal("Expected the in-flight entry to be flushed to disk: ", err)
+	}
+
+	// Tunnels still open at the deadline are closed
+	harProxy = NewHarProxy()
+	harProxy.Start()
+	conn, err := net.Dial("tcp", "127.0.0.1:" + strconv.Itoa(harProxy.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	reader := bufio.NewReader(conn)
+	if resp, err := http.ReadResponse(reader, nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to open: ", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	if err := harProxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected the deadline to pass with the tunnel open, got: ", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatal("Expected the tunnel to be closed, got: ", err)
+	}
+}
+
+func TestHarProxyShutdownMitmKeepAlive(t *testing.T) {
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	ca, roots := newTestCA(t)
+	harProxy := NewHarProxy()
+	harProxy.MitmCA = ca
+	harProxy.wireTransport.TLSClientConfig = acceptAllCerts
+	harProxy.Start()
+	entries := harProxy.Subscribe()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:" + strconv.Itoa(harProxy.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	host := strings.TrimPrefix(upstream.URL, "https://")
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to open: ", err)
+	}
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsConn, "GET / HTTP/1.1\r\nHost: %v\r\n\r\n", host)
+	reader := bufio.NewReader(tlsConn)
+	resp, err := http.ReadResponse(reader, nil)
+	testResp(t, resp, err)
+	ioutil.ReadAll(resp.Body)
+
+	// The intercepted connection is kept alive, and is closed by the shutdown before the entries are finished
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	if err := harProxy.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tlsConn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatal("Expected the intercepted connection to be closed, got: ", err)
+	}
+	if _, ok := <-entries; !ok {
+		t.Fatal("Expected the intercepted entry")
+	}
+	if _, ok := <-entries; ok {
+		t.Fatal("Expected the subscription to end with the proxy")
+	}
+}
+
+func TestHarProxyLogging(t *testing.T) {
+	logs := new(lockedBuffer)
+	harProxy := NewHarProxy()
+	harProxy.Logger = slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	harProxy.Start()
+	defer harProxy.Stop()
+	entries := harProxy.Subscribe()
+	proxyUrl, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(harProxy.Port))
+	resp, err := newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo?token=secret")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	<-entries
+
+	found := false
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal("Expected structured log lines, got: ", line)
+		}
+		if record["msg"] == "Added entry" {
+			found = true
+			if record["port"] != float64(harProxy.Port) {
+				t.Fatal("Expected the proxy's port on its log lines, got: ", line)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("Expected a debug line for the entry, got: ", logs.String())
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Fatal("Expected query strings to be redacted, got: ", logs.String())
+	}
+}
+
+// A buffer proxies can log to while the test reads it
+type lockedBuffer struct {
+	buffer bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+func webSocketEchoHandler(w http.ResponseWriter, r *http.Request) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(buf, header); err != nil {
+		return
+	}
+	payload := make([]byte, header[1] & 0x7f)
+	io.ReadFull(buf, payload)
+	for i := range payload {
+		payload[i] ^= header[2 + i % 4]
+	}
+	conn.Write(append([]byte{header[0], byte(len(payload))}, payload...))
+	ioutil.ReadAll(buf)
+}
+
 // HarProxyServer tests
 
 func TestHarProxyServerGetProxyAndDelete(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
@@ -103,7 +989,7 @@ func TestHarProxyServerGetProxyAndDelete(t *testing.T) {
 }
 
 func TestHarProxyServerSendInvalidMessage(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerUrl := fmt.Sprintf("%v/bla", harProxyServer.URL)
@@ -124,7 +1010,7 @@ func TestHarProxyServerSendInvalidMessage(t *testing.T) {
 }
 
 func TestHarProxyServerGetInvalidProxy(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerHarUrl := fmt.Sprintf("%v/proxy/%v/har", harProxyServer.URL, 9999)
@@ -148,8 +1034,41 @@ func TestHarProxyServerGetInvalidProxy(t *testing.T) {
 	}
 }
 
+func TestHarProxyServerNonNumericPort(t *testing.T) {
+	testClient, harProxyServer, _ := newProxyTestServer()
+	defer harProxyServer.Close()
+	// Signed numbers don't name a port, even that of a running proxy
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+
+	for _, request := range []struct{ method, path string }{
+		{"GET", "/proxy/abc"},
+		{"DELETE", "/proxy/abc"},
+		{"PUT", "/proxy/abc/har"},
+		{"PUT", "/proxy/abc/wait"},
+		{"GET", "/proxy/{port}"},
+		{"PUT", fmt.Sprintf("/proxy/+%v/har", proxyServerPort.Port)},
+		{"GET", "/proxy/-1"},
+		{"PUT", "/proxy/-1/har"},
+	} {
+		req, err := http.NewRequest(request.method, harProxyServer.URL + request.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := testClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var proxyErrorMessage ProxyServerErr
+		json.NewDecoder(resp.Body).Decode(&proxyErrorMessage)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound || proxyErrorMessage.Error != fmt.Sprintf("No such path: [%v]", request.path) {
+			t.Fatal("Expected 404 for ", request.method, " ", request.path, " but got: ", resp.StatusCode, " ", proxyErrorMessage.Error)
+		}
+	}
+}
+
 func TestHarProxyServerSendInvalidProxyMessage(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
@@ -175,7 +1094,7 @@ func TestHarProxyServerSendInvalidProxyMessage(t *testing.T) {
 }
 
 func TestHarProxyServerGetProxyAndEntries(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
@@ -195,11 +1114,10 @@ func TestHarProxyServerGetProxyAndEntries(t *testing.T) {
 }
 
 func TestHarProxyServerGetProxyAndEntriesWithResponseContent(t *testing.T) {
-	captureContent = true
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	proxyServerPort, proxiedClient := getProxiedClientWithOptions(t, harProxyServer, testClient, "captureContent=true")
 	resp, err := proxiedClient.Get(srv.URL + "/query?result=bla")
 	if err != nil {
 		t.Fatal(err)
@@ -228,11 +1146,10 @@ func TestHarProxyServerGetProxyAndEntriesWithResponseContent(t *testing.T) {
 }
 
 func TestHarProxyServerGetProxyAndEntriesWithRequestPostData(t *testing.T) {
-	captureContent = true
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
-	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	proxyServerPort, proxiedClient := getProxiedClientWithOptions(t, harProxyServer, testClient, "captureContent=true")
 	resp, err := proxiedClient.Post(srv.URL + "/bobo", "form-data", strings.NewReader("bla"))
 	if err != nil {
 		t.Fatal(err)
@@ -254,7 +1171,7 @@ func TestHarProxyServerGetProxyAndEntriesWithRequestPostData(t *testing.T) {
 }
 
 func TestHarProxyServerGetProxyChangeHost(t *testing.T) {
-	testClient, harProxyServer := newProxyTestServer()
+	testClient, harProxyServer, _ := newProxyTestServer()
 	defer harProxyServer.Close()
 
 	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
@@ -277,8 +1194,606 @@ func TestHarProxyServerGetProxyChangeHost(t *testing.T) {
 	}
 }
 
+func TestHarProxyServerAnnotations(t *testing.T) {
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	annotationsUrl := fmt.Sprintf("%v/proxy/%v/annotations", harProxyServer.URL, proxyServerPort.Port)
+	req, _ := http.NewRequest("PUT", annotationsUrl, strings.NewReader(`{"_testName": "checkout"}`))
+	resp, err := testClient.Do(req)
+	testResp(t, resp, err)
+
+	resp, err = testClient.Get(annotationsUrl)
+	testResp(t, resp, err)
+	annotations := make(map[string]interface{})
+	json.NewDecoder(resp.Body).Decode(&annotations)
+	if annotations["_testName"] != "checkout" {
+		t.Fatal("Unexpected annotations: ", annotations)
+	}
+
+	req, _ = http.NewRequest("PUT", annotationsUrl, strings.NewReader(`{"testName": "checkout"}`))
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for annotation without a leading _, got: ", resp, err)
+	}
+
+	req, _ = http.NewRequest("DELETE", annotationsUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	if len(proxyServer.lookupProxy(proxyServerPort.Port).Annotations()) != 0 {
+		t.Fatal("Expected annotations to be cleared")
+	}
+
+	pageUrl := fmt.Sprintf("%v/proxy/%v/har/pageRef?pageRef=checkout&pageCustom=", harProxyServer.URL, proxyServerPort.Port)
+	req, _ = http.NewRequest("PUT", pageUrl + url.QueryEscape(`{"_step": "pay"}`), nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	pages := proxyServer.lookupProxy(proxyServerPort.Port).Har().HarLog.Pages
+	if len(pages) != 1 || pages[0].Custom["_step"] != "pay" {
+		t.Fatal("Expected the page's custom fields, got: ", pages)
+	}
+	req, _ = http.NewRequest("PUT", pageUrl + url.QueryEscape(`{"step": "pay"}`), nil)
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for a page custom field without a leading _, got: ", resp, err)
+	}
+}
+
+func TestHarProxyServerMocks(t *testing.T) {
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, proxiedClient := getProxiedClient(t, harProxyServer, testClient)
+	harProxy := proxyServer.lookupProxy(proxyServerPort.Port)
+	entries := harProxy.Subscribe()
+	mocksUrl := fmt.Sprintf("%v/proxy/%v/mocks", harProxyServer.URL, proxyServerPort.Port)
+	for _, rule := range []string{
+		`{"regex": "/bobo$", "method": "POST", "status": 500}`,
+		`{"regex": "/bobo$", "status": 201, "headers": {"Content-Type": "application/json"}, "body": "{\"mocked\": true}"}`,
+	} {
+		resp, err := testClient.Post(mocksUrl, "application/json", strings.NewReader(rule))
+		testResp(t, resp, err)
+		resp.Body.Close()
+	}
+	resp, err := testClient.Post(mocksUrl, "application/json", strings.NewReader(`{"regex": "(", "status": 200}`))
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for an invalid pattern, got: ", resp, err)
+	}
+
+	resp, err = testClient.Get(mocksUrl)
+	testResp(t, resp, err)
+	var mocks []MockRule
+	json.NewDecoder(resp.Body).Decode(&mocks)
+	resp.Body.Close()
+	if len(mocks) != 2 || mocks[0].Method != "POST" || mocks[1].Status != http.StatusCreated {
+		t.Fatal("Unexpected mocks: ", mocks)
+	}
+
+	// The GET request does not match the first mock, so the second answers it
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Content-Type") != "application/json" || string(body) != `{"mocked": true}` {
+		t.Fatal("Expected the mocked response, got: ", resp.Status, resp.Header, string(body))
+	}
+	if harEntry := <-entries; harEntry.Response.Status != http.StatusCreated || harEntry.Response.BodySize != int64(len(body)) {
+		t.Fatal("Expected the mocked response to be recorded, got: ", harEntry.Response)
+	}
+
+	req, _ := http.NewRequest("DELETE", mocksUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = proxiedClient.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "bobo" {
+		t.Fatal("Expected requests to go upstream once mocks are cleared, got: ", string(body))
+	}
+}
+
+func TestHarProxyServerAuth(t *testing.T) {
+	proxyServer, _ := NewServer(ProxyServerConfig{Token: "secret", Username: "user", Password: "pass"})
+	s := httptest.NewServer(proxyServer)
+	defer s.Close()
+
+	tests := []struct {
+		setAuth func(req *http.Request)
+		status  int
+	}{
+		{func(req *http.Request) {}, http.StatusUnauthorized},
+		{func(req *http.Request) { req.Header.Set("Authorization", "Bearer wrong") }, http.StatusUnauthorized},
+		{func(req *http.Request) { req.SetBasicAuth("user", "wrong") }, http.StatusUnauthorized},
+		{func(req *http.Request) { req.Header.Set("Authorization", "Bearer secret") }, http.StatusNotFound},
+		{func(req *http.Request) { req.SetBasicAuth("user", "pass") }, http.StatusNotFound},
+	}
+	for i, test := range tests {
+		req, _ := http.NewRequest("PUT", s.URL + "/proxy/1/har", nil)
+		test.setAuth(req)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Fatal("Expected status ", test.status, " for request ", i, " but got: ", resp.Status)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && len(resp.Header["Www-Authenticate"]) != 2 {
+			t.Fatal("Expected both authentication schemes to be offered, got: ", resp.Header["Www-Authenticate"])
+		}
+	}
+
+	if _, err := NewServer(ProxyServerConfig{TLSCertFile: "cert.pem"}); err == nil {
+		t.Fatal("Expected error for TLS certificate without a key")
+	}
+}
+
+func TestHarProxyServerListProxies(t *testing.T) {
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	first, _ := getProxiedClient(t, harProxyServer, testClient)
+	second, _ := getProxiedClientWithOptions(t, harProxyServer, testClient, "captureContent=true")
+	proxyServer.lookupProxy(second.Port).AddHostEntries([]ProxyHosts{{Host: "a.com", NewHost: "b.com"}})
+
+	resp, err := testClient.Get(harProxyServer.URL + "/proxy")
+	testResp(t, resp, err)
+	infos := make([]ProxyInfo, 0)
+	json.NewDecoder(resp.Body).Decode(&infos)
+	ports := make(map[int]bool)
+	for _, info := range infos {
+		ports[info.Port] = true
+	}
+	if !ports[first.Port] || !ports[second.Port] {
+		t.Fatal("Expected both proxies to be listed, got: ", infos)
+	}
+
+	proxyUrl := fmt.Sprintf("%v/proxy/%v", harProxyServer.URL, second.Port)
+	resp, err = testClient.Get(proxyUrl)
+	testResp(t, resp, err)
+	var info ProxyInfo
+	json.NewDecoder(resp.Body).Decode(&info)
+	if info.Port != second.Port || info.Created.IsZero() || len(info.Hosts) != 1 || info.Hosts[0].NewHost != "b.com" || !info.CaptureContent {
+		t.Fatal("Unexpected proxy info: ", info)
+	}
+	for _, info := range infos {
+		if info.Port == first.Port && info.CaptureContent {
+			t.Fatal("Expected content capture to be off by default, got: ", info)
+		}
+	}
+
+	req, _ := http.NewRequest("DELETE", proxyUrl, nil)
+	resp, err = testClient.Do(req)
+	testResp(t, resp, err)
+	resp, err = testClient.Get(proxyUrl)
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Fatal("Expected deleted proxy not to be found, got: ", resp, err)
+	}
+}
+
+func TestHarProxyServerReapProxies(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "reaped")
+	defer os.RemoveAll(dir)
+	// Proxies get the config's expiry settings unless their options override them
+	proxyServer, _ := NewServer(ProxyServerConfig{ProxyIdleTimeout: time.Minute, ReapHarDir: dir})
+
+	idle, err := proxyServer.CreateProxy(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idle.recordEntry(HarEntry{Request: &HarRequest{Url: "http://reaped"}})
+
+	young, err := proxyServer.CreateProxy(0, url.Values{"ttl": {"1h"}, "idleTimeout": {"0s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer young.Stop()
+
+	// An open tunnel keeps a proxy busy
+	tunneling, err := proxyServer.CreateProxy(0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunneling.Stop()
+	tunnel, err := net.Dial("tcp", "127.0.0.1:" + strconv.Itoa(tunneling.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close()
+	host := strings.TrimPrefix(srv.URL, "http://")
+	fmt.Fprintf(tunnel, "CONNECT %v HTTP/1.1\r\nHost: %v\r\n\r\n", host, host)
+	if resp, err := http.ReadResponse(bufio.NewReader(tunnel), nil); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatal("Expected the tunnel to open: ", err)
+	}
+
+	proxyServer.reapProxies(time.Now().Add(2 * time.Minute))
+	if proxyServer.lookupProxy(idle.Port) != nil {
+		t.Fatal("Expected idle proxy to be reaped")
+	}
+	if proxyServer.lookupProxy(tunneling.Port) != tunneling {
+		t.Fatal("Expected proxy with an open tunnel to be kept")
+	}
+	proxyServer.unregisterProxy(tunneling.Port)
+	if proxyServer.lookupProxy(young.Port) != young {
+		t.Fatal("Expected proxy within its ttl to be kept")
+	}
+	proxyServer.unregisterProxy(young.Port)
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.har"))
+	if len(files) != 1 {
+		t.Fatal("Expected HAR of reaped proxy to be written, got: ", files)
+	}
+	f, _ := os.Open(files[0])
+	defer f.Close()
+	har, err := ParseHar(f)
+	if err != nil || len(har.HarLog.Entries) != 1 || har.HarLog.Entries[0].Request.Url != "http://reaped" {
+		t.Fatal("Unexpected HAR of reaped proxy: ", har, err)
+	}
+}
+
+func TestHarProxyServerOpenApi(t *testing.T) {
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	resp, err := testClient.Get(harProxyServer.URL + "/openapi.json")
+	testResp(t, resp, err)
+	var doc struct {
+		OpenApi    string											`json:"openapi"`
+		Paths      map[string]map[string]map[string]interface{}	`json:"paths"`
+		Components struct {
+			Schemas map[string]struct {
+				Properties map[string]interface{}	`json:"properties"`
+			}	`json:"schemas"`
+		}	`json:"components"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(doc.OpenApi, "3.") {
+		t.Fatal("Expected an OpenAPI 3 document, got: ", doc.OpenApi)
+	}
+	for _, route := range proxyServer.routes {
+		operation := doc.Paths[route.path][strings.ToLower(route.method)]
+		if operation == nil || operation["operationId"] != route.operationId {
+			t.Fatal("Expected route to be described: ", route.method, " ", route.path)
+		}
+	}
+	if _, ok := doc.Components.Schemas["ProxyInfo"].Properties["droppedEntries"]; !ok {
+		t.Fatal("Expected ProxyInfo schema with its json fields, got: ", doc.Components.Schemas["ProxyInfo"])
+	}
+
+	req, _ := http.NewRequest("PATCH", harProxyServer.URL + "/proxy", nil)
+	resp, err = testClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "POST, GET" {
+		t.Fatal("Expected method not allowed with the allowed methods, got: ", resp, err)
+	}
+}
+
+func TestHarProxyServerMetrics(t *testing.T) {
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, _ := getProxiedClient(t, harProxyServer, testClient)
+	proxyUrl, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(proxyServerPort.Port))
+	client := newProxyHttpTestClient(proxyUrl)
+	resp, err := client.Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+	proxyServer.lookupProxy(proxyServerPort.Port).WaitForEntries()
+
+	resp, err = testClient.Get(harProxyServer.URL + "/metrics")
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	port := strconv.Itoa(proxyServerPort.Port)
+	for _, expected := range []string{
+		"goharproxy_proxies 1\n",
+		`goharproxy_requests_total{port="` + port + `",status_class="2xx"} 1` + "\n",
+		`goharproxy_timing_seconds_bucket{port="` + port + `",phase="wait",le="+Inf"} 1` + "\n",
+		`goharproxy_dropped_entries_total{port="` + port + `"} 0` + "\n",
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Fatal("Expected metrics to contain: ", expected, " got: ", string(body))
+		}
+	}
+	// Phases we don't measure are not observed
+	for _, phase := range []string{"send", "receive", "dns"} {
+		if strings.Contains(string(body), `phase="` + phase + `"`) {
+			t.Fatal("Expected no observations of unmeasured phase ", phase, " got: ", string(body))
+		}
+	}
+}
+
+func TestHarProxyServerSlowUpstreamTimings(t *testing.T) {
+	delay := 300 * time.Millisecond
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		io.WriteString(w, "slow")
+	}))
+	defer slow.Close()
+	testClient, harProxyServer, proxyServer := newProxyTestServer()
+	defer harProxyServer.Close()
+
+	proxyServerPort, client := getProxiedClient(t, harProxyServer, testClient)
+	harProxy := proxyServer.lookupProxy(proxyServerPort.Port)
+	entries := harProxy.Subscribe()
+	resp, err := client.Get(slow.URL)
+	testResp(t, resp, err)
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	harEntry := <-entries
+	if millis := float64(delay / time.Millisecond); harEntry.Time < millis || harEntry.Timings.Wait < millis {
+		t.Fatal("Expected the entry to take at least the upstream delay, got: ", harEntry.Time, harEntry.Timings)
+	}
+
+	resp, err = testClient.Get(harProxyServer.URL + "/metrics")
+	testResp(t, resp, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	prefix := `goharproxy_timing_seconds_sum{port="` + strconv.Itoa(proxyServerPort.Port) + `",phase="wait"} `
+	var sum float64
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			sum, _ = strconv.ParseFloat(strings.TrimPrefix(line, prefix), 64)
+		}
+	}
+	if sum < delay.Seconds() {
+		t.Fatal("Expected the wait histogram sum to be at least the upstream delay, got: ", sum, string(body))
+	}
+}
+
+func TestHarProxyServerHealth(t *testing.T) {
+	proxyServer, _ := NewServer(ProxyServerConfig{Token: "secret", MaxProxies: 1})
+	s := httptest.NewServer(proxyServer)
+	defer s.Close()
+
+	getHealth := func(path string, status int) ProxyServerHealth {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Fatal("Expected status ", status, " for ", path, " but got: ", resp.Status)
+		}
+		var health ProxyServerHealth
+		json.NewDecoder(resp.Body).Decode(&health)
+		return health
+	}
+	createProxy := func() *http.Response {
+		req, _ := http.NewRequest("POST", s.URL + "/proxy", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	health := getHealth("/readyz", http.StatusOK)
+	if health.Status != "ok" || !health.CanCreateProxies || health.Proxies != 0 || health.MaxProxies != 1 || health.Listening {
+		t.Fatal("Unexpected health: ", health)
+	}
+
+	resp := createProxy()
+	testResp(t, resp, nil)
+	health = getHealth("/readyz", http.StatusServiceUnavailable)
+	if health.CanCreateProxies || health.Proxies != 1 || health.Reason == "" {
+		t.Fatal("Expected not to be ready with all proxies in use, got: ", health)
+	}
+	if health = getHealth("/healthz", http.StatusOK); health.Status != "unavailable" {
+		t.Fatal("Expected to be alive but unavailable, got: ", health)
+	}
+	if resp = createProxy(); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal("Expected service unavailable beyond the maximum of proxies, got: ", resp.Status)
+	}
+
+	proxyServer.Shutdown(context.Background())
+	if health = getHealth("/readyz", http.StatusServiceUnavailable); health.Proxies != 0 || health.Reason != "Server is shutting down" {
+		t.Fatal("Expected not to be ready while shutting down, got: ", health)
+	}
+}
+
+func TestHarProxyServerPortRange(t *testing.T) {
+	l, _ := net.Listen("tcp", ":0")
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if _, _, err := ParsePortRange("9100-9000"); err == nil {
+		t.Fatal("Expected error for a range ending before it starts")
+	}
+	proxyServer, err := NewServer(ProxyServerConfig{ProxyPortMin: port, ProxyPortMax: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := httptest.NewServer(proxyServer)
+	defer s.Close()
+	defer proxyServer.Shutdown(context.Background())
+
+	resp, err := http.Post(s.URL + "/proxy", "", nil)
+	testResp(t, resp, err)
+	var proxyServerPort ProxyServerPort
+	json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+	if proxyServerPort.Port != port {
+		t.Fatal("Expected proxy on port ", port, " of the range but got: ", proxyServerPort.Port)
+	}
+
+	resp, err = http.Post(s.URL + "/proxy", "", nil)
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatal("Expected service unavailable with every port in use, got: ", resp, err)
+	}
+	var serverErr ProxyServerErr
+	json.NewDecoder(resp.Body).Decode(&serverErr)
+	if !strings.Contains(serverErr.Error, "No free port") {
+		t.Fatal("Unexpected error: ", serverErr.Error)
+	}
+
+	resp, err = http.Post(fmt.Sprintf("%v/proxy?port=%v", s.URL, port + 1), "", nil)
+	if err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected bad request for a port outside the range, got: ", resp, err)
+	}
+}
+
+func TestProxyServerCreateProxyWithDefaults(t *testing.T) {
+	proxyServer, _ := NewServer(ProxyServerConfig{ProxyDefaults: url.Values{"cookieJar": {"true"}, "maxEntries": {"5"}}})
+	defer proxyServer.Shutdown(context.Background())
+
+	harProxy, err := proxyServer.CreateProxy(0, url.Values{"maxEntries": {"7"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if harProxy.CookieJar == nil || harProxy.MaxEntries != 7 || proxyServer.lookupProxy(harProxy.Port) != harProxy {
+		t.Fatal("Expected registered proxy with the defaults under its own options, got: ", harProxy.CookieJar, harProxy.MaxEntries)
+	}
+	if _, err := proxyServer.CreateProxy(0, url.Values{"maxEntries": {"many"}}); err == nil {
+		t.Fatal("Expected error for invalid options")
+	}
+}
+
+func TestProxyServerHarDirUnderBase(t *testing.T) {
+	base, _ := ioutil.TempDir("", "harbase")
+	defer os.RemoveAll(base)
+	withoutBase, _ := NewServer(ProxyServerConfig{})
+	defer withoutBase.Shutdown(context.Background())
+	proxyServer, _ := NewServer(ProxyServerConfig{HarBaseDir: base})
+	defer proxyServer.Shutdown(context.Background())
+
+	if _, err := withoutBase.CreateProxy(0, url.Values{"harDir": {"run"}}); err == nil {
+		t.Fatal("Expected harDir to be refused without a base directory")
+	}
+	for _, dir := range []string{"/tmp/run", "../run", "run/../../run", ".."} {
+		if _, err := proxyServer.CreateProxy(0, url.Values{"harDir": {dir}}); err == nil {
+			t.Fatal("Expected harDir [", dir, "] to be refused")
+		}
+	}
+	harProxy, err := proxyServer.CreateProxy(0, url.Values{"harDir": {"runs/1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(base, "runs", "1"); harProxy.HarFile.Dir != expected {
+		t.Fatal("Expected harDir under the base directory ", expected, " but got: ", harProxy.HarFile.Dir)
+	}
+	if info, err := os.Stat(harProxy.HarFile.Dir); err != nil || !info.IsDir() {
+		t.Fatal("Expected harDir to be created: ", err)
+	}
+
+	if _, err := withoutBase.CreateProxy(0, url.Values{"reapHarDir": {"reaped"}}); err == nil {
+		t.Fatal("Expected reapHarDir to be refused without a base directory")
+	}
+	if _, err := proxyServer.CreateProxy(0, url.Values{"reapHarDir": {"../reaped"}}); err == nil {
+		t.Fatal("Expected reapHarDir outside the base directory to be refused")
+	}
+	harProxy, err = proxyServer.CreateProxy(0, url.Values{"reapHarDir": {"reaped"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(base, "reaped"); harProxy.ReapHarDir != expected {
+		t.Fatal("Expected reapHarDir under the base directory ", expected, " but got: ", harProxy.ReapHarDir)
+	}
+}
+
+func TestProxyServerStartAndShutdown(t *testing.T) {
+	first, _ := NewServer(ProxyServerConfig{BindAddress: "127.0.0.1"})
+	second, _ := NewServer(ProxyServerConfig{BindAddress: "127.0.0.1"})
+	for _, proxyServer := range []*ProxyServer{first, second} {
+		if err := proxyServer.Start(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer second.Shutdown(context.Background())
+
+	apiUrl := func(proxyServer *ProxyServer) string {
+		return "http://127.0.0.1:" + strconv.Itoa(proxyServer.Port) + "/proxy"
+	}
+	ports := make([]int, 0, 2)
+	for _, proxyServer := range []*ProxyServer{first, second} {
+		resp, err := http.Post(apiUrl(proxyServer), "", nil)
+		testResp(t, resp, err)
+		var proxyServerPort ProxyServerPort
+		json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+		resp.Body.Close()
+		ports = append(ports, proxyServerPort.Port)
+	}
+	for i, proxyServer := range []*ProxyServer{first, second} {
+		proxies := proxyServer.Proxies()
+		if len(proxies) != 1 || proxies[0].Port != ports[i] {
+			t.Fatal("Expected each server to list only its own proxy, got: ", proxies)
+		}
+	}
+
+	if err := first.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get(apiUrl(first)); err == nil {
+		t.Fatal("Expected the API of the shut down server to be closed")
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:" + strconv.Itoa(ports[0])); err == nil {
+		t.Fatal("Expected the proxies of the shut down server to be stopped")
+	}
+	resp, err := http.Get(apiUrl(second))
+	testResp(t, resp, err)
+	resp.Body.Close()
+}
+
+func TestProxyServerShutdownWithOpenCalls(t *testing.T) {
+	proxyServer, _ := NewServer(ProxyServerConfig{BindAddress: "127.0.0.1"})
+	if err := proxyServer.Start(); err != nil {
+		t.Fatal(err)
+	}
+	apiUrl := "http://127.0.0.1:" + strconv.Itoa(proxyServer.Port) + "/proxy"
+	resp, err := http.Post(apiUrl, "", nil)
+	testResp(t, resp, err)
+	var proxyServerPort ProxyServerPort
+	json.NewDecoder(resp.Body).Decode(&proxyServerPort)
+	resp.Body.Close()
+	proxyApiUrl := apiUrl + "/" + strconv.Itoa(proxyServerPort.Port)
+	// Traffic, so the wait has something to wait out
+	proxyUrl, _ := url.Parse("http://127.0.0.1:" + strconv.Itoa(proxyServerPort.Port))
+	resp, err = newProxyHttpTestClient(proxyUrl).Get(srv.URL + "/bobo")
+	testResp(t, resp, err)
+	resp.Body.Close()
+
+	stream, err := http.Get(proxyApiUrl + "/har/stream")
+	testResp(t, stream, err)
+	defer stream.Body.Close()
+	waited := make(chan int)
+	go func() {
+		req, _ := http.NewRequest("PUT", proxyApiUrl + "/wait?quietPeriod=1h&timeout=1h", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			waited <- 0
+			return
+		}
+		resp.Body.Close()
+		waited <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := proxyServer.Shutdown(ctx); err != nil {
+		t.Fatal("Expected the open stream and wait not to hold the shutdown up, got: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2 * time.Second {
+		t.Fatal("Expected the shutdown not to wait for its deadline, took: ", elapsed)
+	}
+	if status := <-waited; status != http.StatusServiceUnavailable {
+		t.Fatal("Expected the wait to be ended with 503, got: ", status)
+	}
+	if _, err := ioutil.ReadAll(stream.Body); err != nil {
+		t.Fatal("Expected the stream to end, got: ", err)
+	}
+}
+
 func getProxiedClient(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client) (proxyServerPort *ProxyServerPort, client *http.Client) {
-	resp, err := testClient.Post(harProxyServer.URL + "/proxy", "", nil)
+	return getProxiedClientWithOptions(t, harProxyServer, testClient, "")
+}
+
+// Creates a proxy with options, the query string of POST /proxy
+func getProxiedClientWithOptions(t *testing.T, harProxyServer *httptest.Server, testClient *http.Client, options string) (proxyServerPort *ProxyServerPort, client *http.Client) {
+	resp, err := testClient.Post(harProxyServer.URL + "/proxy?" + options, "", nil)
 	testResp(t, resp, err)
 
 	proxyServerPort = new(ProxyServerPort)
@@ -286,15 +1801,16 @@ func getProxiedClient(t *testing.T, harProxyServer *httptest.Server, testClient
 		log.Fatal(e)
 	}
 
-	host, _, _ := net.SplitHostPort(harProxyServer.URL)
-	proxyUrl, _ := url.Parse(host + ":" + strconv.Itoa(proxyServerPort.Port))
+	serverUrl, _ := url.Parse(harProxyServer.URL)
+	proxyUrl, _ := url.Parse("http://" + net.JoinHostPort(serverUrl.Hostname(), strconv.Itoa(proxyServerPort.Port)))
 	client = newProxyHttpTestClient(proxyUrl)
 	return
 }
 
 func testLog(t *testing.T, r io.Reader) *HarLog{
-	var harLog *HarLog = new(HarLog)
-	json.NewDecoder(r).Decode(harLog)
+	var har *Har = new(Har)
+	json.NewDecoder(r).Decode(har)
+	harLog := &har.HarLog
 	log.Printf("Har entries len: %v", len(harLog.Entries))
 	if len(harLog.Entries) == 0 {
 		t.Fatal("Didn't get valid har entries")
@@ -317,8 +1833,9 @@ func oneShotProxy() (client *http.Client, harProxy *HarProxy, s *httptest.Server
 	return
 }
 
-func newProxyTestServer() (client *http.Client, s *httptest.Server) {
-	s = httptest.NewServer(http.HandlerFunc(proxyHandler))
+func newProxyTestServer() (client *http.Client, s *httptest.Server, proxyServer *ProxyServer) {
+	proxyServer, _ = NewServer(ProxyServerConfig{})
+	s = httptest.NewServer(proxyServer)
 
 	tr := &http.Transport{TLSClientConfig: acceptAllCerts}
 	client = &http.Client{Transport: tr}
@@ -326,7 +1843,7 @@ func newProxyTestServer() (client *http.Client, s *httptest.Server) {
 }
 
 func newProxyHttpTestServer(harProxy *HarProxy) (client *http.Client, s *httptest.Server) {
-	s = httptest.NewServer(harProxy.Proxy)
+	s = httptest.NewServer(harProxy)
 	proxyUrl, _ := url.Parse(s.URL)
 	client = newProxyHttpTestClient(proxyUrl)
 	return
@@ -0,0 +1,81 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Health and readiness of the proxy server, for orchestrators' probes
+
+type ProxyServerHealth struct {
+	// ok, or unavailable when new proxies can't be created
+	Status string	`json:"status"`
+
+	// Whether the server is listening itself, false when mounted on another server's router
+	Listening bool		`json:"listening"`
+	Address   string	`json:"address,omitempty"`
+
+	Proxies    int	`json:"proxies"`
+	// Limit on Proxies, 0 for none
+	MaxProxies int	`json:"maxProxies"`
+
+	CanCreateProxies bool	`json:"canCreateProxies"`
+	// Why new proxies can't be created
+	Reason           string	`json:"reason,omitempty"`
+}
+
+func (server *ProxyServer) health() ProxyServerHealth {
+	server.stateLock.Lock()
+	health := ProxyServerHealth{
+		Listening  : server.listening,
+		MaxProxies : server.Config.MaxProxies,
+	}
+	if server.listening {
+		health.Address = server.address
+	}
+	shuttingDown := server.shuttingDown
+	server.stateLock.Unlock()
+
+	health.Proxies = len(server.listProxies())
+	if err := server.canCreateProxy(shuttingDown); err != nil {
+		health.Status = "unavailable"
+		health.Reason = err.Error()
+	} else {
+		health.Status = "ok"
+		health.CanCreateProxies = true
+	}
+	return health
+}
+
+// Why a proxy can't be created, nil when it can
+func (server *ProxyServer) canCreateProxy(shuttingDown bool) error {
+	if shuttingDown {
+		return errors.New("Server is shutting down")
+	}
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+	return server.capacityError()
+}
+
+func (server *ProxyServer) isShuttingDown() bool {
+	server.stateLock.Lock()
+	defer server.stateLock.Unlock()
+	return server.shuttingDown
+}
+
+// Answers 200 while the server is running, even when it can't create proxies
+func writeHealth(server *ProxyServer, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server.health())
+}
+
+// Answers 503 when new proxies can't be created
+func writeReadiness(server *ProxyServer, w http.ResponseWriter) {
+	health := server.health()
+	w.Header().Add("Content-Type", "application/json")
+	if !health.CanCreateProxies {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(health)
+}
@@ -0,0 +1,49 @@
+package goharproxy
+
+import (
+	"log/slog"
+	"net/url"
+)
+
+// Logging
+
+// The server's Config.Logger, slog.Default() when nil
+func (server *ProxyServer) logger() *slog.Logger {
+	if server.Config.Logger != nil {
+		return server.Config.Logger
+	}
+	return slog.Default()
+}
+
+// The proxy's Logger, or slog.Default() when nil, with the proxy's port in the "port" attribute
+func (proxy *HarProxy) logger() *slog.Logger {
+	base := proxy.Logger
+	if base == nil {
+		base = slog.Default()
+	}
+	return base.With("port", proxy.Port)
+}
+
+// The url to log, without its credentials and query string unless the proxy's LogSensitive
+func (proxy *HarProxy) logUrl(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	if proxy.LogSensitive {
+		return u.String()
+	}
+	redacted := *u
+	redacted.User = nil
+	if redacted.RawQuery != "" {
+		redacted.RawQuery = "redacted"
+	}
+	return redacted.String()
+}
+
+func (proxy *HarProxy) logRawUrl(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return proxy.logUrl(u)
+}
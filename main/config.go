@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"github.com/Hellspam/goharproxy"
+)
+
+// Config file and environment overrides of our flags
+
+// Settings of the config file, by the flag each sets.
+// Each can also be set with an environment variable, see envName.
+var settingFlags = map[string]string{
+	"port"             : "p",
+	"bind"             : "bind",
+	"verbose"          : "v",
+	"logSensitive"     : "log-sensitive",
+	"caCert"           : "ca-cert",
+	"caKey"            : "ca-key",
+	"token"            : "token",
+	"basicAuth"        : "basic-auth",
+	"tlsCert"          : "tls-cert",
+	"tlsKey"           : "tls-key",
+	"proxyTtl"         : "proxy-ttl",
+	"proxyIdleTimeout" : "proxy-idle-timeout",
+	"reapHarDir"       : "reap-har-dir",
+	"harBaseDir"       : "har-base-dir",
+	"maxProxies"       : "max-proxies",
+	"portRange"        : "port-range",
+	"shutdownTimeout"  : "shutdown-timeout",
+}
+
+type configFile struct {
+	// Values of flags, by flag name
+	settings map[string]string
+	// Query parameters of POST /proxy applied to proxies created without them
+	proxyDefaults url.Values
+	proxies       []bootProxy
+}
+
+// A proxy started with the server
+type bootProxy struct {
+	Port      int						`json:"port"`
+	// Query parameters of POST /proxy, such as {"cookieJar": true}
+	Options   map[string]interface{}	`json:"options"`
+	Hosts     []goharproxy.ProxyHosts	`json:"hosts"`
+	Blacklist []blacklistRule			`json:"blacklist"`
+	Mocks     []goharproxy.MockRule		`json:"mocks"`
+}
+
+type blacklistRule struct {
+	Regex  string	`json:"regex"`
+	Status int		`json:"status"`
+}
+
+// Reads a json config file, such as:
+//
+//	{
+//		"port": 8080,
+//		"token": "secret",
+//		"portRange": "9000-9100",
+//		"proxyDefaults": {"cookieJar": true, "maxEntries": 1000, "upstream": "http://proxy:3128"},
+//		"proxies": [{"port": 9000, "hosts": [{"host": "a.com", "NewHost": "b.com"}], "blacklist": [{"regex": "ads", "status": 404}],
+//			"mocks": [{"regex": "/api/user$", "method": "GET", "status": 200, "headers": {"Content-Type": "application/json"}, "body": "{}"}]}]
+//	}
+func loadConfig(path string) (*configFile, error) {
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		return nil, fmt.Errorf("Config file [%v]: only json config files are supported", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := decodeJson(data, &fields); err != nil {
+		return nil, fmt.Errorf("Config file [%v]: %v", path, err)
+	}
+
+	config := &configFile{settings: make(map[string]string)}
+	for key, raw := range fields {
+		switch key {
+		case "proxyDefaults":
+			var options map[string]interface{}
+			err = decodeJson(raw, &options)
+			config.proxyDefaults = optionValues(options)
+		case "proxies":
+			err = decodeJson(raw, &config.proxies)
+		default:
+			name, ok := settingFlags[key]
+			if !ok {
+				return nil, fmt.Errorf("Config file [%v]: unknown setting [%v]", path, key)
+			}
+			var value interface{}
+			err = decodeJson(raw, &value)
+			config.settings[name] = fmt.Sprint(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Config file [%v]: invalid %v: %v", path, key, err)
+		}
+	}
+	return config, nil
+}
+
+// Decodes json keeping numbers as written, and rejecting unknown fields of structs
+func decodeJson(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func optionValues(options map[string]interface{}) url.Values {
+	values := url.Values{}
+	for name, value := range options {
+		values.Set(name, fmt.Sprint(value))
+	}
+	return values
+}
+
+// The environment variable overriding a setting, such as GOHARPROXY_BASIC_AUTH for basicAuth
+func envName(key string) string {
+	var name strings.Builder
+	name.WriteString("GOHARPROXY_")
+	for i, r := range key {
+		if i > 0 && unicode.IsUpper(r) {
+			name.WriteByte('_')
+		}
+		name.WriteRune(unicode.ToUpper(r))
+	}
+	return name.String()
+}
+
+// Sets the flags not given on the command line from the environment, then from config, which may be nil
+func applySettings(config *configFile) error {
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for key, name := range settingFlags {
+		if given[name] {
+			continue
+		}
+		value, ok := os.LookupEnv(envName(key))
+		if !ok && config != nil {
+			value, ok = config.settings[name]
+		}
+		if !ok {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("Invalid %v [%v]: %v", key, value, err)
+		}
+	}
+	return nil
+}
+
+// Starts the config's proxies on server, with their hosts, blacklists and mocks
+func startBootProxies(server *goharproxy.ProxyServer, config *configFile) error {
+	for i, boot := range config.proxies {
+		harProxy, err := server.CreateProxy(boot.Port, optionValues(boot.Options))
+		if err != nil {
+			return fmt.Errorf("Starting proxy %v of the config file: %v", i, err)
+		}
+		if len(boot.Hosts) > 0 {
+			harProxy.AddHostEntries(boot.Hosts)
+		}
+		for _, rule := range boot.Blacklist {
+			if err := harProxy.Blacklist(rule.Regex, rule.Status); err != nil {
+				return fmt.Errorf("Blacklist of proxy %v of the config file: %v", i, err)
+			}
+		}
+		for _, mock := range boot.Mocks {
+			if err := harProxy.AddMock(mock); err != nil {
+				return fmt.Errorf("Mock of proxy %v of the config file: %v", i, err)
+			}
+		}
+		slog.Info("Started proxy of the config file", "port", harProxy.Port)
+	}
+	return nil
+}
@@ -2,6 +2,15 @@ package main
 
 import (
 	"flag"
+	"log"
+	"crypto/tls"
+	"strings"
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"log/slog"
 	
 	"github.com/Hellspam/goharproxy"
 //	_ "net/http/pprof"
@@ -10,13 +19,113 @@ import (
 
 func main() {
 	port := flag.Int("p", 8080, "Port to listen on")
-	verbose := flag.Bool("v", true, "Verbosity")
+	configPath := flag.String("config", "", "Json file of settings, proxy defaults and proxies to start, also read from GOHARPROXY_CONFIG")
+	verbose := flag.Bool("v", false, "Log at debug level, including every proxied request")
+	logSensitive := flag.Bool("log-sensitive", false, "Log whole HARs, and urls with their query strings and credentials")
+	caCert := flag.String("ca-cert", "", "CA certificate used to intercept https traffic, requires -ca-key")
+	caKey := flag.String("ca-key", "", "Private key of the CA certificate")
+	bind := flag.String("bind", "", "Address the REST API listens on, all interfaces when empty")
+	token := flag.String("token", "", "Bearer token clients of the REST API must send")
+	basicAuth := flag.String("basic-auth", "", "user:password clients of the REST API must authenticate with")
+	tlsCert := flag.String("tls-cert", "", "Certificate to serve the REST API over TLS with, requires -tls-key")
+	tlsKey := flag.String("tls-key", "", "Private key of the TLS certificate")
+	proxyTTL := flag.Duration("proxy-ttl", 0, "How long proxies live unless created with their own ttl, 0 for ever")
+	proxyIdleTimeout := flag.Duration("proxy-idle-timeout", 0, "How long proxies live without traffic or API calls unless created with their own idleTimeout, 0 for ever")
+	reapHarDir := flag.String("reap-har-dir", "", "Directory the HAR of expired proxies is written to before they are stopped")
+	harBaseDir := flag.String("har-base-dir", "", "Directory the harDir and reapHarDir options of new proxies are resolved under, the options are refused when empty")
+	maxProxies := flag.Int("max-proxies", 0, "Proxies which may exist at once, 0 for no limit")
+	portRange := flag.String("port-range", "", "Ports proxies listen on, such as 9000-9100, any free port when empty")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 20 * time.Second, "How long in-flight requests get to finish on SIGTERM or SIGINT before their connections are closed")
 	flag.Parse()
+	if *configPath == "" {
+		*configPath = os.Getenv("GOHARPROXY_CONFIG")
+	}
+	var configFile *configFile
+	if *configPath != "" {
+		var err error
+		if configFile, err = loadConfig(*configPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := applySettings(configFile); err != nil {
+		log.Fatal(err)
+	}
 //	go func() {
 //		log.Println(http.ListenAndServe("localhost:6060", nil))
 //	}()
-	goharproxy.Verbosity = *verbose
-	goharproxy.NewProxyServer(*port)
+	level := slog.LevelInfo
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	config := goharproxy.ProxyServerConfig{
+		BindAddress		 : *bind,
+		Port			 : *port,
+		Token			 : *token,
+		TLSCertFile		 : *tlsCert,
+		TLSKeyFile		 : *tlsKey,
+		MaxProxies		 : *maxProxies,
+		HarBaseDir		 : *harBaseDir,
+		ProxyTTL		 : *proxyTTL,
+		ProxyIdleTimeout : *proxyIdleTimeout,
+		ReapHarDir		 : *reapHarDir,
+		LogSensitive	 : *logSensitive,
+		Verbose			 : *verbose,
+	}
+	if *caCert != "" {
+		ca, err := tls.LoadX509KeyPair(*caCert, *caKey)
+		if err != nil {
+			log.Fatal("Loading CA: ", err)
+		}
+		config.MitmCA = &ca
+	}
+	if configFile != nil {
+		config.ProxyDefaults = configFile.proxyDefaults
+	}
+	if *portRange != "" {
+		min, max, err := goharproxy.ParsePortRange(*portRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.ProxyPortMin, config.ProxyPortMax = min, max
+	}
+	if *basicAuth != "" {
+		credentials := strings.SplitN(*basicAuth, ":", 2)
+		if len(credentials) != 2 {
+			log.Fatal("Invalid -basic-auth, expected user:password")
+		}
+		config.Username, config.Password = credentials[0], credentials[1]
+	}
+
+	server, err := goharproxy.NewServer(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if configFile != nil {
+		if err := startBootProxies(server, configFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serverErr:
+		log.Fatal(err)
+	case sig := <-signals:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Warn("Shut down with connections still open", "err", err)
+	}
+	slog.Info("Shut down")
 }
 
 
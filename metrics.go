@@ -0,0 +1,229 @@
+package goharproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Prometheus metrics
+
+// Upper bounds, in seconds, of the buckets of timing histograms
+var timingBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// What a proxy counts of its traffic, since it was created
+type proxyMetrics struct {
+	lock sync.Mutex
+	metricCounts
+}
+
+type metricCounts struct {
+	requests       map[string]int64
+	upstreamErrors int64
+	requestBytes   int64
+	responseBytes  int64
+	droppedEntries int64
+	timings        map[string]*histogram
+}
+
+type histogram struct {
+	// Observations in each of timingBuckets, not cumulative
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{metricCounts: metricCounts{
+		requests : make(map[string]int64),
+		timings  : make(map[string]*histogram),
+	}}
+}
+
+// Counts a processed entry
+func (metrics *proxyMetrics) observe(harEntry *HarEntry) {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	if response := harEntry.Response; response != nil {
+		if response.Status == 0 {
+			metrics.upstreamErrors++
+		} else {
+			metrics.requests[strconv.Itoa(response.Status / 100) + "xx"]++
+		}
+		metrics.responseBytes += nonNegative(response.HeadersSize) + nonNegative(response.BodySize)
+	}
+	if request := harEntry.Request; request != nil {
+		metrics.requestBytes += nonNegative(request.HeadersSize) + nonNegative(request.BodySize)
+	}
+
+	// Send and receive are left out, we don't measure them and the HAR can't mark them so, they are always 0
+	timings := harEntry.Timings
+	phases := map[string]float64{
+		"blocked" : timings.Blocked, "dns" : timings.Dns, "connect" : timings.Connect, "wait" : timings.Wait, "ssl" : timings.Ssl,
+	}
+	for phase, millis := range phases {
+		// Phases which do not apply or were not measured are -1
+		if millis < 0 {
+			continue
+		}
+		h := metrics.timings[phase]
+		if h == nil {
+			h = &histogram{counts: make([]int64, len(timingBuckets))}
+			metrics.timings[phase] = h
+		}
+		h.observe(millis / 1000)
+	}
+}
+
+func (metrics *proxyMetrics) dropEntry() {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	metrics.droppedEntries++
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range timingBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func nonNegative(n int64) int64 {
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Writes metrics in the Prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// Writes a sample, labels being pairs of names and values
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels) / 2)
+	for i := 0; i + 1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%v=%q", labels[i], labels[i + 1]))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%v %v\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func writeMetrics(proxies []*HarProxy, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := metricsWriter{w}
+
+	m.header("goharproxy_proxies", "gauge", "Number of active proxies.")
+	m.sample("goharproxy_proxies", float64(len(proxies)))
+
+	m.header("goharproxy_requests_in_flight", "gauge", "Requests being proxied.")
+	for _, harProxy := range proxies {
+		m.sample("goharproxy_requests_in_flight", float64(atomic.LoadInt64(&harProxy.requestsInProcess)), "port", strconv.Itoa(harProxy.Port))
+	}
+	m.header("goharproxy_entries_in_flight", "gauge", "Entries being processed.")
+	for _, harProxy := range proxies {
+		m.sample("goharproxy_entries_in_flight", float64(atomic.LoadInt64(&harProxy.entriesInProcess)), "port", strconv.Itoa(harProxy.Port))
+	}
+
+	// Copied so the proxies can keep counting while we write
+	snapshots := make([]metricCounts, len(proxies))
+	for i, harProxy := range proxies {
+		snapshots[i] = harProxy.metrics.snapshot()
+	}
+
+	m.header("goharproxy_requests_total", "counter", "Requests answered, by status class.")
+	for i, harProxy := range proxies {
+		port := strconv.Itoa(harProxy.Port)
+		for _, class := range snapshots[i].statusClasses() {
+			m.sample("goharproxy_requests_total", float64(snapshots[i].requests[class]), "port", port, "status_class", class)
+		}
+	}
+	counters := []struct {
+		name  string
+		help  string
+		value func(counts *metricCounts) int64
+	}{
+		{"goharproxy_upstream_errors_total", "Requests which got no response from upstream.", func(counts *metricCounts) int64 { return counts.upstreamErrors }},
+		{"goharproxy_request_bytes_total", "Bytes of request headers and bodies received from clients.", func(counts *metricCounts) int64 { return counts.requestBytes }},
+		{"goharproxy_response_bytes_total", "Bytes of response headers and bodies sent to clients.", func(counts *metricCounts) int64 { return counts.responseBytes }},
+		{"goharproxy_dropped_entries_total", "Entries dropped to stay within the proxy's limits.", func(counts *metricCounts) int64 { return counts.droppedEntries }},
+	}
+	for _, counter := range counters {
+		m.header(counter.name, "counter", counter.help)
+		for i, harProxy := range proxies {
+			m.sample(counter.name, float64(counter.value(&snapshots[i])), "port", strconv.Itoa(harProxy.Port))
+		}
+	}
+
+	m.header("goharproxy_timing_seconds", "histogram", "Time spent in each phase of a request, from its HAR timings.")
+	for i, harProxy := range proxies {
+		port := strconv.Itoa(harProxy.Port)
+		for _, phase := range snapshots[i].phases() {
+			h := snapshots[i].timings[phase]
+			var cumulative int64
+			for j, bound := range timingBuckets {
+				cumulative += h.counts[j]
+				m.sample("goharproxy_timing_seconds_bucket", float64(cumulative), "port", port, "phase", phase, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+			}
+			m.sample("goharproxy_timing_seconds_bucket", float64(h.count), "port", port, "phase", phase, "le", "+Inf")
+			m.sample("goharproxy_timing_seconds_sum", h.sum, "port", port, "phase", phase)
+			m.sample("goharproxy_timing_seconds_count", float64(h.count), "port", port, "phase", phase)
+		}
+	}
+}
+
+func (metrics *proxyMetrics) snapshot() metricCounts {
+	metrics.lock.Lock()
+	defer metrics.lock.Unlock()
+	snapshot := metricCounts{
+		requests		: make(map[string]int64, len(metrics.requests)),
+		upstreamErrors	: metrics.upstreamErrors,
+		requestBytes	: metrics.requestBytes,
+		responseBytes	: metrics.responseBytes,
+		droppedEntries	: metrics.droppedEntries,
+		timings			: make(map[string]*histogram, len(metrics.timings)),
+	}
+	for class, count := range metrics.requests {
+		snapshot.requests[class] = count
+	}
+	for phase, h := range metrics.timings {
+		copied := *h
+		copied.counts = append([]int64(nil), h.counts...)
+		snapshot.timings[phase] = &copied
+	}
+	return snapshot
+}
+
+func (counts *metricCounts) statusClasses() []string {
+	classes := make([]string, 0, len(counts.requests))
+	for class := range counts.requests {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	return classes
+}
+
+func (counts *metricCounts) phases() []string {
+	phases := make([]string, 0, len(counts.timings))
+	for phase := range counts.timings {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	return phases
+}
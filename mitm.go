@@ -0,0 +1,253 @@
+package goharproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Man in the middle
+
+// How long we wait for a client to speak first on a CONNECT tunnel before treating it as opaque
+var connectPeekTimeout = time.Second
+
+// Certificates we signed, by host name
+type certificateCache struct {
+	lock         sync.Mutex
+	certificates map[string]*tls.Certificate
+}
+
+func newCertificateCache() *certificateCache {
+	return &certificateCache{certificates : make(map[string]*tls.Certificate)}
+}
+
+func (cache *certificateCache) get(host string, ca *tls.Certificate) (*tls.Certificate, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if cert, ok := cache.certificates[host]; ok {
+		return cert, nil
+	}
+	cert, err := signHost(host, ca)
+	if err != nil {
+		return nil, err
+	}
+	cache.certificates[host] = cert
+	return cert, nil
+}
+
+func signHost(host string, ca *tls.Certificate) (*tls.Certificate, error) {
+	if len(ca.Certificate) == 0 {
+		return nil, errors.New("CA has no certificate")
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber : serial,
+		Subject		 : pkix.Name{CommonName: host},
+		NotBefore	 : time.Now().Add(-time.Hour),
+		NotAfter	 : time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage	 : x509.KeyUsageDigitalSignature,
+		ExtKeyUsage	 : []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate : [][]byte{der, ca.Certificate[0]},
+		PrivateKey	: key,
+	}, nil
+}
+
+// Checks whether the client starts a CONNECT tunnel with a TLS handshake we can intercept
+func (proxy *HarProxy) shouldMitm(client net.Conn, clientBuf *bufio.ReadWriter) bool {
+	if proxy.MitmCA == nil {
+		return false
+	}
+	client.SetReadDeadline(time.Now().Add(connectPeekTimeout))
+	first, err := clientBuf.Peek(1)
+	client.SetReadDeadline(time.Time{})
+	return err == nil && first[0] == 0x16
+}
+
+// Terminates TLS on a CONNECT tunnel and serves the requests inside it through our go proxy,
+// negotiating HTTP/2 with the client when enabled. The requests are sent by the user who opened the tunnel.
+func (proxy *HarProxy) serveMitm(client net.Conn, clientBuf *bufio.ReadWriter, host string, username string) {
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	tlsConfig := &tls.Config{
+		NextProtos : []string{"http/1.1"},
+		GetCertificate : func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = hostname
+			}
+			return proxy.certificates.get(name, proxy.MitmCA)
+		},
+	}
+	if proxy.Http2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	server := &http.Server{
+		ConnContext : withWireConn,
+		Handler : http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if r.URL.Host == "" {
+				r.URL.Host = host
+			}
+			proxy.serveProxied(w, withProxyUser(r, username))
+		}),
+	}
+	tlsConn := tls.Server(&bufferedConn{client, clientBuf.Reader}, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		proxy.logger().Warn("Error intercepting connection", "host", host, "err", err)
+		tlsConn.Close()
+		return
+	}
+	var conn net.Conn = tlsConn
+	if tlsConn.ConnectionState().NegotiatedProtocol != "h2" {
+		// Served as plain HTTP/1.1, so the bytes of its requests are kept decrypted
+		conn = newWireConn(tlsConn)
+	}
+	// Serve returns once the connection is accepted, the server is kept until the connection closes so shutdowns wait for it
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateClosed || state == http.StateHijacked {
+			proxy.removeMitmServer(server)
+		}
+	}
+	if !proxy.addMitmServer(server) {
+		conn.Close()
+		return
+	}
+	if err := server.Serve(&singleConnListener{conn: conn}); err != errListenerDone {
+		if err != http.ErrServerClosed {
+			proxy.logger().Warn("Error intercepting connection", "host", host, "err", err)
+		}
+		proxy.removeMitmServer(server)
+		conn.Close()
+	}
+}
+
+// Registers the server of an intercepted connection, false when the proxy is shutting down
+func (proxy *HarProxy) addMitmServer(server *http.Server) bool {
+	proxy.hijackedLock.Lock()
+	defer proxy.hijackedLock.Unlock()
+	if proxy.mitmShutdown {
+		return false
+	}
+	proxy.mitmServers[server] = true
+	return true
+}
+
+func (proxy *HarProxy) removeMitmServer(server *http.Server) {
+	proxy.hijackedLock.Lock()
+	defer proxy.hijackedLock.Unlock()
+	delete(proxy.mitmServers, server)
+}
+
+// Shuts the servers of intercepted connections down, closing their idle connections and waiting for
+// the others to finish their requests until ctx is done
+func (proxy *HarProxy) shutdownMitm(ctx context.Context) error {
+	servers := proxy.stopMitm()
+	errs := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			errs <- server.Shutdown(ctx)
+		}(server)
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Closes the servers of intercepted connections and their connections
+func (proxy *HarProxy) closeMitm() {
+	for _, server := range proxy.stopMitm() {
+		server.Close()
+	}
+}
+
+// Stops registering servers of intercepted connections, returning those registered
+func (proxy *HarProxy) stopMitm() []*http.Server {
+	proxy.hijackedLock.Lock()
+	defer proxy.hijackedLock.Unlock()
+	proxy.mitmShutdown = true
+	servers := make([]*http.Server, 0, len(proxy.mitmServers))
+	for server := range proxy.mitmServers {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// A connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+var errListenerDone = errors.New("Listener done")
+
+// Hands a single connection to http.Server, which keeps serving it after Accept stops
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn == nil {
+		return nil, errListenerDone
+	}
+	return conn, nil
+}
+
+func (l *singleConnListener) Close() error {
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
@@ -0,0 +1,97 @@
+package goharproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mocking responses
+
+// A response served instead of sending matching requests upstream
+type MockRule struct {
+	// Regular expression urls are matched against
+	Regex  string	`json:"regex"`
+	// Method of the requests answered, any when empty
+	Method string	`json:"method,omitempty"`
+
+	Status  int					`json:"status"`
+	Headers map[string]string	`json:"headers,omitempty"`
+	Body    string				`json:"body,omitempty"`
+}
+
+type mockEntry struct {
+	rule    MockRule
+	pattern *regexp.Regexp
+}
+
+// Answers requests matching rule with its response instead of sending them upstream.
+// Their entries are still recorded. Rules added first win, and mocks are looked up before the blacklist.
+// Applies to http requests, and to https when it is intercepted.
+func (proxy *HarProxy) AddMock(rule MockRule) error {
+	regex, err := regexp.Compile(rule.Regex)
+	if err != nil {
+		return err
+	}
+	if rule.Status < 100 || rule.Status > 999 {
+		return fmt.Errorf("Invalid status [%v]", rule.Status)
+	}
+	proxy.mocksLock.Lock()
+	defer proxy.mocksLock.Unlock()
+	proxy.mocks = append(proxy.mocks, mockEntry{rule, regex})
+	return nil
+}
+
+// The rules added with AddMock, in the order they are looked up
+func (proxy *HarProxy) Mocks() []MockRule {
+	proxy.mocksLock.Lock()
+	defer proxy.mocksLock.Unlock()
+	rules := make([]MockRule, 0, len(proxy.mocks))
+	for _, entry := range proxy.mocks {
+		rules = append(rules, entry.rule)
+	}
+	return rules
+}
+
+func (proxy *HarProxy) ClearMocks() {
+	proxy.mocksLock.Lock()
+	defer proxy.mocksLock.Unlock()
+	proxy.mocks = nil
+}
+
+// The response of the first mock matching req, false when none does
+func (proxy *HarProxy) mockResponse(req *http.Request) (*http.Response, bool) {
+	proxy.mocksLock.Lock()
+	defer proxy.mocksLock.Unlock()
+	url := req.URL.String()
+	for _, entry := range proxy.mocks {
+		if (entry.rule.Method == "" || strings.EqualFold(entry.rule.Method, req.Method)) && entry.pattern.MatchString(url) {
+			return mockedResponse(req, entry.rule), true
+		}
+	}
+	return nil, false
+}
+
+func mockedResponse(req *http.Request, rule MockRule) *http.Response {
+	header := make(http.Header)
+	for name, value := range rule.Headers {
+		header.Set(name, value)
+	}
+	body := []byte(rule.Body)
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Status		  : fmt.Sprintf("%d %s", rule.Status, http.StatusText(rule.Status)),
+		StatusCode	  : rule.Status,
+		Proto		  : "HTTP/1.1",
+		ProtoMajor	  : 1,
+		ProtoMinor	  : 1,
+		Header		  : header,
+		Body		  : ioutil.NopCloser(bytes.NewReader(body)),
+		ContentLength : int64(len(body)),
+		Request		  : req,
+	}
+}
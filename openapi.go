@@ -0,0 +1,208 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// OpenAPI description of the REST API, generated from our routes
+
+func writeOpenApi(server *ProxyServer, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(server.openApi())
+}
+
+// The OpenAPI 3 document describing the server's routes
+func (server *ProxyServer) openApi() map[string]interface{} {
+	schemas := &schemaBuilder{schemas: make(map[string]interface{})}
+	errorResponse := map[string]interface{}{
+		"description" : "Error",
+		"content" : map[string]interface{}{
+			"application/json" : map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(ProxyServerErr{}))},
+		},
+	}
+
+	paths := make(map[string]map[string]interface{})
+	for _, route := range server.routes {
+		operation := map[string]interface{}{
+			"operationId" : route.operationId,
+			"summary" : route.summary,
+			"responses" : map[string]interface{}{
+				"200" : schemas.response(route),
+				"default" : errorResponse,
+			},
+		}
+		var parameters []interface{}
+		if strings.Contains(route.path, "{port}") {
+			parameters = append(parameters, map[string]interface{}{
+				"name" : "port", "in" : "path", "required" : true,
+				"description" : "Port of the proxy",
+				"schema" : map[string]interface{}{"type": "integer"},
+			})
+		}
+		for _, param := range route.params {
+			parameters = append(parameters, map[string]interface{}{
+				"name" : param.name, "in" : "query", "description" : param.description,
+				"schema" : paramSchema(param.kind),
+			})
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		if route.body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required" : true,
+				"content" : map[string]interface{}{
+					"application/json" : map[string]interface{}{"schema": schemas.schema(reflect.TypeOf(route.body))},
+				},
+			}
+		}
+		if route.public {
+			operation["security"] = []interface{}{}
+		}
+		if paths[route.path] == nil {
+			paths[route.path] = make(map[string]interface{})
+		}
+		paths[route.path][strings.ToLower(route.method)] = operation
+	}
+
+	components := map[string]interface{}{"schemas": schemas.schemas}
+	doc := map[string]interface{}{
+		"openapi" : "3.0.3",
+		"info" : map[string]interface{}{
+			"title" : "goharproxy",
+			"description" : "Creates proxies recording the traffic sent through them as HAR",
+			"version" : "0.1",
+		},
+		"paths" : paths,
+		"components" : components,
+	}
+	securitySchemes := make(map[string]interface{})
+	var security []interface{}
+	if server.Config.Token != "" {
+		securitySchemes["bearerAuth"] = map[string]interface{}{"type": "http", "scheme": "bearer"}
+		security = append(security, map[string]interface{}{"bearerAuth": []string{}})
+	}
+	if server.Config.Username != "" {
+		securitySchemes["basicAuth"] = map[string]interface{}{"type": "http", "scheme": "basic"}
+		security = append(security, map[string]interface{}{"basicAuth": []string{}})
+	}
+	if security != nil {
+		components["securitySchemes"] = securitySchemes
+		doc["security"] = security
+	}
+	return doc
+}
+
+func paramSchema(kind string) map[string]interface{} {
+	if kind == "duration" {
+		return map[string]interface{}{"type": "string", "format": "duration", "example": "30s"}
+	}
+	return map[string]interface{}{"type": kind}
+}
+
+// Builds the schemas of Go types, named structs are added to the document's components
+type schemaBuilder struct {
+	schemas map[string]interface{}
+}
+
+func (builder *schemaBuilder) response(route route) map[string]interface{} {
+	response := map[string]interface{}{"description": "OK"}
+	if route.response == nil {
+		return response
+	}
+	schema := builder.schema(reflect.TypeOf(route.response))
+	contentTypes := route.responseTypes
+	if contentTypes == nil {
+		contentTypes = []string{"application/json"}
+	}
+	content := make(map[string]interface{})
+	for _, contentType := range contentTypes {
+		content[contentType] = map[string]interface{}{"schema": schema}
+	}
+	response["content"] = content
+	return response
+}
+
+func (builder *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch t {
+	case reflect.TypeOf(time.Time{}):
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case reflect.TypeOf(time.Duration(0)):
+		return map[string]interface{}{"type": "integer", "description": "Nanoseconds"}
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return builder.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": builder.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": builder.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return builder.structSchema(t)
+		}
+		if _, ok := builder.schemas[t.Name()]; !ok {
+			// Added before its fields so types referring to themselves end
+			builder.schemas[t.Name()] = nil
+			builder.schemas[t.Name()] = builder.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// Properties of the struct's json fields, those without omitempty are required
+func (builder *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" && !field.Anonymous {
+			continue
+		}
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := builder.structSchema(field.Type)
+			for name, property := range embedded["properties"].(map[string]interface{}) {
+				properties[name] = property
+			}
+			if embeddedRequired, ok := embedded["required"].([]string); ok {
+				required = append(required, embeddedRequired...)
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = builder.schema(field.Type)
+		if !strings.Contains(tag, ",omitempty") {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if required != nil {
+		schema["required"] = required
+	}
+	return schema
+}
@@ -0,0 +1,182 @@
+package goharproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Allocating the ports of new proxies
+
+// Parses a range of ports such as 9000-9100
+func ParsePortRange(portRange string) (min int, max int, err error) {
+	bounds := strings.SplitN(portRange, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("Invalid port range [%v], expected min-max", portRange)
+	}
+	if min, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range [%v], expected min-max", portRange)
+	}
+	if max, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+		return 0, 0, fmt.Errorf("Invalid port range [%v], expected min-max", portRange)
+	}
+	return min, max, validatePortRange(min, max)
+}
+
+func validatePortRange(min int, max int) error {
+	if min == 0 && max == 0 {
+		return nil
+	}
+	if min <= 0 || max > 65535 || min > max {
+		return fmt.Errorf("Invalid port range [%v-%v]", min, max)
+	}
+	return nil
+}
+
+func (config ProxyServerConfig) hasPortRange() bool {
+	return config.ProxyPortMin != 0
+}
+
+// Creates a proxy with params, the query parameters of POST /proxy, over Config.ProxyDefaults and
+// the defaults of Config. It listens on port, or on a free port of our range when 0.
+func (server *ProxyServer) CreateProxy(port int, params url.Values) (*HarProxy, error) {
+	harProxy := server.newHarProxy()
+	merged := url.Values{}
+	for name, values := range server.Config.ProxyDefaults {
+		merged[name] = values
+	}
+	for name, values := range params {
+		merged[name] = values
+	}
+	if err := applyProxyParams(harProxy, merged, server.Config.HarBaseDir); err != nil {
+		close(harProxy.entryChannel)
+		return nil, &statusError{http.StatusBadRequest, err.Error()}
+	}
+	if err := server.startProxy(harProxy, port); err != nil {
+		close(harProxy.entryChannel)
+		return nil, err
+	}
+	return harProxy, nil
+}
+
+// A proxy with the settings of our config, logging through our logger
+func (server *ProxyServer) newHarProxy() *HarProxy {
+	config := server.Config
+	harProxy := NewHarProxy()
+	harProxy.TTL = config.ProxyTTL
+	harProxy.IdleTimeout = config.ProxyIdleTimeout
+	harProxy.ReapHarDir = config.ReapHarDir
+	harProxy.MitmCA = config.MitmCA
+	harProxy.Logger = config.Logger
+	harProxy.LogSensitive = config.LogSensitive
+	harProxy.Proxy.Verbose = config.Verbose || Verbosity
+	return harProxy
+}
+
+// Starts harProxy on port, or on a free port of our range when 0, and registers it.
+// Ports of the range other processes listen on are skipped.
+func (server *ProxyServer) startProxy(harProxy *HarProxy, port int) error {
+	tried := make(map[int]bool)
+	for {
+		allocated, err := server.allocatePort(port, tried)
+		if err != nil {
+			return err
+		}
+		harProxy.Port = allocated
+		err = harProxy.start()
+		if err == nil {
+			server.releasePort(allocated, harProxy)
+			return nil
+		}
+		server.releasePort(allocated, nil)
+		if allocated == 0 {
+			return err
+		}
+		if port != 0 {
+			return &statusError{http.StatusConflict, fmt.Sprintf("Can't listen on port [%v]: %v", port, err)}
+		}
+		server.logger().Debug("Skipping port of the range in use", "port", allocated, "err", err)
+		tried[allocated] = true
+	}
+}
+
+// Reserves port, or a free port of our range other than those tried when 0, until releasePort.
+// Ports are chosen by the system when we have no range.
+func (server *ProxyServer) allocatePort(port int, tried map[int]bool) (int, error) {
+	if server.isShuttingDown() {
+		return 0, &statusError{http.StatusServiceUnavailable, "Server is shutting down"}
+	}
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+
+	config := server.Config
+	if port != 0 {
+		if config.hasPortRange() && (port < config.ProxyPortMin || port > config.ProxyPortMax) {
+			return 0, &statusError{http.StatusBadRequest,
+				fmt.Sprintf("Port [%v] is outside the range [%v-%v]", port, config.ProxyPortMin, config.ProxyPortMax)}
+		}
+		if server.proxies[port] != nil || server.reservedPorts[port] {
+			return 0, &statusError{http.StatusConflict, fmt.Sprintf("Port [%v] is in use", port)}
+		}
+	}
+	if err := server.capacityError(); err != nil {
+		return 0, &statusError{http.StatusServiceUnavailable, err.Error()}
+	}
+	if port == 0 && config.hasPortRange() {
+		for candidate := config.ProxyPortMin; candidate <= config.ProxyPortMax; candidate++ {
+			if server.proxies[candidate] == nil && !server.reservedPorts[candidate] && !tried[candidate] {
+				port = candidate
+				break
+			}
+		}
+		if port == 0 {
+			return 0, &statusError{http.StatusServiceUnavailable,
+				fmt.Sprintf("No free port in the range [%v-%v]", config.ProxyPortMin, config.ProxyPortMax)}
+		}
+	}
+	if port != 0 {
+		server.reservedPorts[port] = true
+	}
+	server.pendingProxies++
+	return port, nil
+}
+
+// Ends the reservation of port, registering harProxy, started on it, unless nil
+func (server *ProxyServer) releasePort(port int, harProxy *HarProxy) {
+	server.proxiesLock.Lock()
+	defer server.proxiesLock.Unlock()
+	delete(server.reservedPorts, port)
+	server.pendingProxies--
+	if harProxy != nil {
+		server.proxies[harProxy.Port] = harProxy
+		server.startReaper()
+	}
+}
+
+// Why no more proxies fit, nil when one does. Called with proxiesLock held.
+func (server *ProxyServer) capacityError() error {
+	config := server.Config
+	proxies := len(server.proxies) + server.pendingProxies
+	if config.MaxProxies > 0 && proxies >= config.MaxProxies {
+		return fmt.Errorf("Reached the maximum of %v proxies", config.MaxProxies)
+	}
+	if config.hasPortRange() {
+		used := 0
+		for port := range server.proxies {
+			if port >= config.ProxyPortMin && port <= config.ProxyPortMax {
+				used++
+			}
+		}
+		for port := range server.reservedPorts {
+			if server.proxies[port] == nil {
+				used++
+			}
+		}
+		if used >= config.ProxyPortMax - config.ProxyPortMin + 1 {
+			return fmt.Errorf("No free port in the range [%v-%v]", config.ProxyPortMin, config.ProxyPortMax)
+		}
+	}
+	return nil
+}
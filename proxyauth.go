@@ -0,0 +1,78 @@
+package goharproxy
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// Proxy authentication
+
+type proxyUserKey struct{}
+
+// SetProxyCredentials sets the passwords, by username, clients must send in Proxy-Authorization.
+// Clients are not authenticated when there are none.
+func (proxy *HarProxy) SetProxyCredentials(credentials map[string]string) {
+	copied := make(map[string]string, len(credentials))
+	for username, password := range credentials {
+		copied[username] = password
+	}
+	proxy.proxyAuthLock.Lock()
+	defer proxy.proxyAuthLock.Unlock()
+	proxy.proxyCredentials = copied
+}
+
+// Checks the client's Proxy-Authorization, answering 407 when it is missing or wrong.
+// The header is removed so it is neither sent upstream nor recorded.
+// Returns the authenticated username, empty when clients are not authenticated.
+func (proxy *HarProxy) authenticateClient(w http.ResponseWriter, r *http.Request) (string, bool) {
+	authorization := r.Header.Get("Proxy-Authorization")
+	r.Header.Del("Proxy-Authorization")
+
+	proxy.proxyAuthLock.Lock()
+	credentials := proxy.proxyCredentials
+	proxy.proxyAuthLock.Unlock()
+	if len(credentials) == 0 {
+		return "", true
+	}
+
+	username, password, ok := parseBasicAuth(authorization)
+	if expected, found := credentials[username]; ok && found && secureEqual(password, expected) {
+		return username, true
+	}
+	w.Header().Set("Proxy-Authenticate", `Basic realm="goharproxy"`)
+	writeErrorMessage(w, http.StatusProxyAuthRequired, "Proxy authentication required")
+	return "", false
+}
+
+// Parses the credentials of a basic Authorization or Proxy-Authorization header
+func parseBasicAuth(authorization string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 {
+		return "", "", false
+	}
+	return credentials[0], credentials[1], true
+}
+
+// Marks a request as sent by an authenticated user
+func withProxyUser(r *http.Request, username string) *http.Request {
+	if username == "" {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), proxyUserKey{}, username))
+}
+
+// The user who sent a request, empty when clients are not authenticated
+func proxyUser(r *http.Request) string {
+	username, _ := r.Context().Value(proxyUserKey{}).(string)
+	return username
+}
@@ -0,0 +1,108 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy details
+
+// What the REST API reports about a proxy
+type ProxyInfo struct {
+	Port           int			`json:"port"`
+	Created        time.Time	`json:"created"`
+	Entries        int			`json:"entries"`
+	DroppedEntries int64		`json:"droppedEntries"`
+
+	// Capture settings
+	CaptureContent          bool			`json:"captureContent"`
+	Mitm                    bool			`json:"mitm"`
+	Http2                   bool			`json:"http2"`
+	WebSocketMaxMessageSize int				`json:"webSocketMaxMessageSize"`
+	WebSocketMaxMessages    int				`json:"webSocketMaxMessages"`
+	WebSocketMetadataOnly   bool			`json:"webSocketMetadataOnly"`
+	CookieJar               bool			`json:"cookieJar"`
+	ProxyAuth               bool			`json:"proxyAuth"`
+	RecordProxyUser         bool			`json:"recordProxyUser"`
+	MaxEntries              int				`json:"maxEntries,omitempty"`
+	MaxBodyBytes            int64			`json:"maxBodyBytes,omitempty"`
+	EvictionPolicy          string			`json:"evictionPolicy,omitempty"`
+	HarFile                 *HarFileOptions	`json:"harFile,omitempty"`
+
+	// Expiry settings, durations in nanoseconds
+	TTL          time.Duration	`json:"ttl,omitempty"`
+	IdleTimeout  time.Duration	`json:"idleTimeout,omitempty"`
+	LastActivity time.Time		`json:"lastActivity"`
+	ReapHarDir   string			`json:"reapHarDir,omitempty"`
+
+	Hosts []ProxyHosts	`json:"hosts"`
+
+	// The proxies http and https requests are sent through, the proxy's upstream or those of the environment,
+	// without their credentials. Empty when they connect directly.
+	UpstreamHttp  string	`json:"upstreamHttp,omitempty"`
+	UpstreamHttps string	`json:"upstreamHttps,omitempty"`
+}
+
+func (proxy *HarProxy) Info() ProxyInfo {
+	proxy.proxyAuthLock.Lock()
+	proxyAuth := len(proxy.proxyCredentials) > 0
+	proxy.proxyAuthLock.Unlock()
+
+	return ProxyInfo{
+		Port					: proxy.Port,
+		Created					: proxy.Created,
+		Entries					: proxy.entryCount(),
+		DroppedEntries			: proxy.DroppedEntries(),
+		CaptureContent			: proxy.CaptureContent,
+		Mitm					: proxy.MitmCA != nil,
+		Http2					: proxy.Http2,
+		WebSocketMaxMessageSize : proxy.WebSocketMaxMessageSize,
+		WebSocketMaxMessages	: proxy.WebSocketMaxMessages,
+		WebSocketMetadataOnly	: proxy.WebSocketMetadataOnly,
+		CookieJar				: proxy.CookieJar != nil,
+		ProxyAuth				: proxyAuth,
+		RecordProxyUser			: proxy.RecordProxyUser,
+		MaxEntries				: proxy.MaxEntries,
+		MaxBodyBytes			: proxy.MaxBodyBytes,
+		EvictionPolicy			: proxy.EvictionPolicy,
+		HarFile					: proxy.HarFile,
+		TTL						: proxy.TTL,
+		IdleTimeout				: proxy.IdleTimeout,
+		LastActivity			: time.Unix(0, atomic.LoadInt64(&proxy.lastActivity)),
+		ReapHarDir				: proxy.ReapHarDir,
+		Hosts					: proxy.HostEntries(),
+		UpstreamHttp			: proxy.upstreamFor("http://example.com"),
+		UpstreamHttps			: proxy.upstreamFor("https://example.com"),
+	}
+}
+
+// The proxy requests to rawurl are sent through, without its credentials
+func (proxy *HarProxy) upstreamFor(rawurl string) string {
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		return ""
+	}
+	proxyUrl, err := proxy.upstreamProxy(req)
+	if err != nil || proxyUrl == nil {
+		return ""
+	}
+	redacted := *proxyUrl
+	redacted.User = nil
+	return redacted.String()
+}
+
+func writeProxyInfos(proxies []*HarProxy, w http.ResponseWriter) {
+	infos := make([]ProxyInfo, len(proxies))
+	for i, harProxy := range proxies {
+		infos[i] = harProxy.Info()
+	}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+func writeProxyInfo(harProxy *HarProxy, w http.ResponseWriter) {
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(harProxy.Info())
+}
@@ -0,0 +1,307 @@
+package goharproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proxy server configuration
+
+// How the REST API managing proxies is served
+type ProxyServerConfig struct {
+	// Address the API listens on, such as 127.0.0.1, all interfaces when empty
+	BindAddress string
+	Port        int
+
+	// When set, clients must send "Authorization: Bearer [Token]"
+	Token string
+
+	// When Username is set, clients must authenticate with these basic auth credentials.
+	// Clients may use either when both a token and credentials are set.
+	Username string
+	Password string
+
+	// Serve the API over TLS with this certificate and key
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Proxies which may exist at once, no limit when 0
+	MaxProxies int
+
+	// Ports proxies listen on, such as 9000 to 9100, any free port when both are 0
+	ProxyPortMin int
+	ProxyPortMax int
+
+	// Query parameters of POST /proxy applied to proxies created without them, such as cookieJar=true
+	ProxyDefaults url.Values
+
+	// Directory the harDir and reapHarDir options of POST /proxy are resolved under, the options are refused when empty
+	HarBaseDir string
+
+	// Defaults for new proxies: how long they live, and how long they live without traffic or API calls. Zero for ever.
+	ProxyTTL         time.Duration
+	ProxyIdleTimeout time.Duration
+	// Directory the HAR of reaped proxies is written to by default, empty to discard it
+	ReapHarDir string
+
+	// CA used to sign certificates for intercepted https connections of new proxies, nil to tunnel https untouched
+	MitmCA *tls.Certificate
+
+	// Logger the server and its proxies write to, slog.Default() when nil.
+	// Lines about a proxy carry its port in the "port" attribute.
+	Logger *slog.Logger
+	// Log whole HAR documents, and urls with their query strings and credentials.
+	// Off by default as they may hold bodies, tokens and passwords.
+	LogSensitive bool
+	// Have proxies log each request they handle
+	Verbose bool
+}
+
+func (config ProxyServerConfig) validate() error {
+	if (config.TLSCertFile == "") != (config.TLSKeyFile == "") {
+		return errors.New("TLS requires both a certificate and a key")
+	}
+	if config.Username == "" && config.Password != "" {
+		return errors.New("Basic auth requires a username")
+	}
+	if config.MaxProxies < 0 {
+		return errors.New("The maximum of proxies can't be negative")
+	}
+	if err := validatePortRange(config.ProxyPortMin, config.ProxyPortMax); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (config ProxyServerConfig) authRequired() bool {
+	return config.Token != "" || config.Username != ""
+}
+
+// Serves the REST API managing proxies, with a registry of its own so several can run side by side.
+// It is an http.Handler, so it can be mounted on another router instead of being started.
+type ProxyServer struct {
+	Config ProxyServerConfig
+
+	// Port the API listens on once started, chosen by the system when Config.Port is 0
+	Port int
+
+	proxies     map[int]*HarProxy
+	proxiesLock sync.Mutex
+	// Ports of proxies being started, and how many are
+	reservedPorts  map[int]bool
+	pendingProxies int
+
+	routes  []route
+	handler http.Handler
+	server  *http.Server
+
+	// Guards listening, address and shuttingDown
+	stateLock    sync.Mutex
+	listening    bool
+	address      string
+	shuttingDown bool
+
+	reaperOnce   sync.Once
+	shutdownOnce sync.Once
+	stopReaper   chan bool
+	// Closed on shutdown, ending the API calls waiting on proxies
+	closing chan bool
+}
+
+// NewServer returns a server for the REST API with config's options, see Start and ListenAndServe
+func NewServer(config ProxyServerConfig) (*ProxyServer, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	server := &ProxyServer{
+		Config		: config,
+		Port		: config.Port,
+		proxies		: make(map[int]*HarProxy),
+		reservedPorts : make(map[int]bool),
+		stopReaper	: make(chan bool),
+		closing		: make(chan bool),
+		routes		: apiRoutes(),
+	}
+	server.handler = server.newHandler()
+	server.server = &http.Server{Handler : server}
+	return server, nil
+}
+
+// Serves the REST API with config's authentication until the server fails
+func NewProxyServerWithConfig(config ProxyServerConfig) error {
+	server, err := NewServer(config)
+	if err != nil {
+		return err
+	}
+	return server.ListenAndServe()
+}
+
+func (server *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.handler.ServeHTTP(w, r)
+}
+
+// Listens on the configured address and serves the API in the background
+func (server *ProxyServer) Start() error {
+	l, err := server.listen()
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := server.serve(l); err != nil {
+			server.logger().Error("Error serving HAR Proxy server", "apiPort", server.Port, "err", err)
+		}
+	}()
+	return nil
+}
+
+// Serves the API until the server fails, or returns nil once it is shut down
+func (server *ProxyServer) ListenAndServe() error {
+	l, err := server.listen()
+	if err != nil {
+		return err
+	}
+	return server.serve(l)
+}
+
+func (server *ProxyServer) listen() (net.Listener, error) {
+	addr := net.JoinHostPort(server.Config.BindAddress, strconv.Itoa(server.Config.Port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	server.Port = l.Addr().(*net.TCPAddr).Port
+	server.stateLock.Lock()
+	server.listening = true
+	server.address = l.Addr().String()
+	server.stateLock.Unlock()
+	server.logger().Info("Started HAR Proxy server, waiting for proxy start requests", "addr", l.Addr().String(), "tls", server.Config.TLSCertFile != "")
+	return l, nil
+}
+
+func (server *ProxyServer) serve(l net.Listener) error {
+	defer func() {
+		server.stateLock.Lock()
+		server.listening = false
+		server.stateLock.Unlock()
+	}()
+	var err error
+	if server.Config.TLSCertFile != "" {
+		err = server.server.ServeTLS(l, server.Config.TLSCertFile, server.Config.TLSKeyFile)
+	} else {
+		err = server.server.Serve(l)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Shutdown stops the API from accepting connections and shuts down every proxy at once,
+// draining them until ctx is done. API calls waiting on proxies are ended rather than waited for,
+// and streams of entries end once their proxy is done. Returns the first error met.
+func (server *ProxyServer) Shutdown(ctx context.Context) error {
+	server.shutdownOnce.Do(func() {
+		server.stateLock.Lock()
+		server.shuttingDown = true
+		server.stateLock.Unlock()
+		close(server.stopReaper)
+		close(server.closing)
+	})
+
+	var firstErr error
+	var errLock sync.Mutex
+	setErr := func(err error) {
+		errLock.Lock()
+		defer errLock.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var wg sync.WaitGroup
+	// Streams of entries last until their proxy is shut down, so the API is shut down alongside the proxies
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		setErr(server.server.Shutdown(ctx))
+	}()
+	for _, harProxy := range server.listProxies() {
+		if server.unregisterProxy(harProxy.Port) != harProxy {
+			continue
+		}
+		wg.Add(1)
+		go func(harProxy *HarProxy) {
+			defer wg.Done()
+			setErr(harProxy.Shutdown(ctx))
+		}(harProxy)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// The proxies created through the API, ordered by port
+func (server *ProxyServer) Proxies() []*HarProxy {
+	return server.listProxies()
+}
+
+func (server *ProxyServer) newHandler() http.Handler {
+	mux := http.HandlerFunc(server.serveRoute)
+	config := server.Config
+	if !config.authRequired() {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !server.isPublic(r) && !config.authorized(r) {
+			if config.Token != "" {
+				w.Header().Add("WWW-Authenticate", `Bearer realm="goharproxy"`)
+			}
+			if config.Username != "" {
+				w.Header().Add("WWW-Authenticate", `Basic realm="goharproxy"`)
+			}
+			writeErrorMessage(w, http.StatusUnauthorized, "Unauthorized")
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (config ProxyServerConfig) authorized(r *http.Request) bool {
+	authorization := r.Header.Get("Authorization")
+	if config.Token != "" && strings.HasPrefix(authorization, "Bearer ") {
+		return secureEqual(strings.TrimPrefix(authorization, "Bearer "), config.Token)
+	}
+	if config.Username != "" {
+		if username, password, ok := r.BasicAuth(); ok {
+			// Both are compared so a wrong username takes as long as a wrong password
+			usernameOk := secureEqual(username, config.Username)
+			passwordOk := secureEqual(password, config.Password)
+			return usernameOk && passwordOk
+		}
+	}
+	return false
+}
+
+// Compares secrets in constant time
+func secureEqual(given string, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// Whether the request is for a route served without authentication
+func (server *ProxyServer) isPublic(r *http.Request) bool {
+	for _, route := range server.routes {
+		if route.public && route.method == r.Method && route.path == r.URL.Path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package goharproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// Reaping expired proxies
+
+// How often we look for expired proxies
+var reapInterval = 5 * time.Second
+
+// Notes that the proxy is in use
+func (proxy *HarProxy) touch() {
+	atomic.StoreInt64(&proxy.lastActivity, time.Now().UnixNano())
+}
+
+// Whether the proxy outlived its TTL, or was idle for its IdleTimeout. Open tunnels and websockets keep it busy.
+func (proxy *HarProxy) expired(now time.Time) bool {
+	if proxy.TTL > 0 && now.Sub(proxy.Created) >= proxy.TTL {
+		return true
+	}
+	lastActivity := time.Unix(0, atomic.LoadInt64(&proxy.lastActivity))
+	return proxy.IdleTimeout > 0 && now.Sub(lastActivity) >= proxy.IdleTimeout && !proxy.hasHijacked()
+}
+
+// Reaps the server's proxies until it is shut down
+func (server *ProxyServer) startReaper() {
+	server.reaperOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(reapInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case now := <-ticker.C:
+					server.reapProxies(now)
+				case <-server.stopReaper:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Stops and removes the proxies expired by now
+func (server *ProxyServer) reapProxies(now time.Time) {
+	for _, harProxy := range server.listProxies() {
+		if harProxy.expired(now) && server.unregisterProxy(harProxy.Port) == harProxy {
+			reapProxy(harProxy)
+		}
+	}
+}
+
+func reapProxy(harProxy *HarProxy) {
+	harProxy.logger().Info("Reaping expired proxy")
+	harProxy.Stop()
+	if harProxy.ReapHarDir == "" {
+		return
+	}
+	harProxy.WaitForEntries()
+	if err := dumpHar(harProxy); err != nil {
+		harProxy.logger().Error("Error writing HAR of reaped proxy", "err", err)
+	}
+}
+
+// Writes the proxy's HAR to its reap directory
+func dumpHar(harProxy *HarProxy) error {
+	data, err := json.Marshal(harProxy.takeHar())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(harProxy.ReapHarDir, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("har-%v-reaped-%v.har", harProxy.Port, time.Now().Format("20060102-150405"))
+	return ioutil.WriteFile(filepath.Join(harProxy.ReapHarDir, name), data, 0644)
+}
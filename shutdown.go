@@ -0,0 +1,132 @@
+package goharproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Graceful shutdown
+
+// How long Stop lets in-flight requests and tunnels finish before closing them
+var stopGracePeriod = 5 * time.Second
+
+// How long requests get to return once their connections were closed, after which their entries are abandoned
+var closeGracePeriod = 1 * time.Second
+
+// Shutdown stops accepting connections and waits for in-flight requests, tunnels, websockets and intercepted
+// connections until ctx is done, after which they are closed. The entries they produced are then processed
+// and the HAR file, if any, is completed. Returns ctx's error when connections had to be closed.
+func (proxy *HarProxy) Shutdown(ctx context.Context) error {
+	proxy.logger().Info("Shutting down proxy")
+	err := proxy.server.Shutdown(ctx)
+	if err == nil {
+		err = proxy.shutdownMitm(ctx)
+	}
+	if err == nil {
+		err = proxy.waitForRequests(ctx)
+	}
+	if err != nil {
+		proxy.logger().Warn("Closing the connections still open", "err", err)
+		proxy.server.Close()
+		proxy.closeMitm()
+		proxy.closeHijacked()
+		closeCtx, cancel := context.WithTimeout(context.Background(), closeGracePeriod)
+		defer cancel()
+		if proxy.waitForRequests(closeCtx) != nil {
+			// Their entries could still be sent, so the entry channel is left open
+			proxy.logger().Warn("Abandoning requests still running", "requests", atomic.LoadInt64(&proxy.requestsInProcess))
+			proxy.closeSubscribers()
+			return err
+		}
+	}
+	<-proxy.isDone
+	// No request is left to send entries, but connections are closed all the same
+	proxy.closeHijacked()
+	proxy.finishEntries()
+	return err
+}
+
+// Processes the entries still pending, then closes the entry channel, subscribers and HAR file
+func (proxy *HarProxy) finishEntries() {
+	proxy.WaitForEntries()
+	close(proxy.entryChannel)
+	proxy.closeSubscribers()
+	if writer := proxy.fileWriter(); writer != nil {
+		if err := writer.close(); err != nil {
+			proxy.logger().Error("Error completing HAR file", "err", err)
+		}
+	}
+}
+
+func (proxy *HarProxy) waitForRequests(ctx context.Context) error {
+	for atomic.LoadInt64(&proxy.requestsInProcess) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+// Takes over a client connection, which is closed if it is still open when the proxy shuts down
+func (proxy *HarProxy) hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Connection does not support hijacking")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if wire, ok := conn.(*wireConn); ok {
+		wire.stopRecording()
+	}
+	hijacked := &hijackedConn{Conn: conn, proxy: proxy}
+	proxy.hijackedLock.Lock()
+	defer proxy.hijackedLock.Unlock()
+	proxy.hijackedConns[hijacked] = true
+	return hijacked, buf, nil
+}
+
+func (proxy *HarProxy) closeHijacked() {
+	proxy.hijackedLock.Lock()
+	conns := make([]*hijackedConn, 0, len(proxy.hijackedConns))
+	for conn := range proxy.hijackedConns {
+		conns = append(conns, conn)
+	}
+	proxy.hijackedLock.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Whether connections taken over for tunnels, websockets or interception are open
+func (proxy *HarProxy) hasHijacked() bool {
+	proxy.hijackedLock.Lock()
+	defer proxy.hijackedLock.Unlock()
+	return len(proxy.hijackedConns) > 0
+}
+
+// A hijacked client connection, forgotten by its proxy once closed, which counts as activity
+type hijackedConn struct {
+	net.Conn
+	proxy *HarProxy
+	once  sync.Once
+}
+
+func (conn *hijackedConn) Close() error {
+	conn.once.Do(func() {
+		conn.proxy.hijackedLock.Lock()
+		defer conn.proxy.hijackedLock.Unlock()
+		delete(conn.proxy.hijackedConns, conn)
+		conn.proxy.touch()
+	})
+	return conn.Conn.Close()
+}
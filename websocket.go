@@ -0,0 +1,459 @@
+package goharproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket
+
+var defaultWebSocketMaxMessageSize int = 64 * 1024
+var defaultWebSocketMaxMessages int = 10000
+
+// Largest request / response head we look at before giving up on recognizing a websocket handshake
+var maxWebSocketHeadSize int = 64 * 1024
+
+// Recorded the same way Chrome DevTools records websocket frames in _webSocketMessages
+type HarWebSocketMessage struct {
+	Type   string	`json:"type"`
+	Time   float64	`json:"time"`
+	Opcode int		`json:"opcode"`
+	Data   string	`json:"data"`
+}
+
+func isWebSocketRequest(req *http.Request) bool {
+	return req.Method == "GET" &&
+		headerContains(req.Header, "Connection", "upgrade") &&
+		headerContains(req.Header, "Upgrade", "websocket")
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header[name] {
+		for _, s := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(s), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Proxies a websocket handshake sent to us as an absolute url, and records the frames that follow it
+func (proxy *HarProxy) serveWebSocket(w http.ResponseWriter, r *http.Request) {
+	replaceHost(r, proxy)
+	upstream, err := proxy.dialWebSocket(r)
+	if err != nil {
+		writeErrorMessage(w, http.StatusBadGateway, err.Error())
+		return
+	}
+
+	client, clientBuf, err := proxy.hijack(w)
+	if err != nil {
+		upstream.Close()
+		proxy.logger().Error("Error hijacking websocket connection", "url", proxy.logUrl(r.URL), "err", err)
+		return
+	}
+
+	conn := newWebSocketConn(proxy, r)
+	conn.proxyUser = proxyUser(r)
+	conn.reqHeadersSize = requestHeadersSize(r)
+	r.Header.Del("Proxy-Connection")
+	r.RequestURI = ""
+	if err := r.Write(upstream); err != nil {
+		proxy.logger().Warn("Error sending websocket handshake", "url", proxy.logUrl(r.URL), "err", err)
+		client.Close()
+		upstream.Close()
+		return
+	}
+	conn.pipe(client, clientBuf, upstream)
+}
+
+func (proxy *HarProxy) dialWebSocket(r *http.Request) (net.Conn, error) {
+	host := r.URL.Host
+	secure := r.URL.Scheme == "https" || r.URL.Scheme == "wss"
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if secure {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	conn, err := proxy.dialUpstream(host)
+	if err != nil || !secure {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: r.URL.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// Tunnels a CONNECT request, recording websocket frames when the tunnel carries a plain websocket.
+// TLS is intercepted when the proxy has a CA to sign certificates with, anything else is passed through untouched.
+func (proxy *HarProxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	replaceHost(r, proxy)
+	var upstream net.Conn
+	var err error
+	if proxy.MitmCA == nil {
+		if upstream, err = proxy.dialUpstream(r.URL.Host); err != nil {
+			writeErrorMessage(w, http.StatusBadGateway, err.Error())
+			return
+		}
+	}
+
+	client, clientBuf, err := proxy.hijack(w)
+	if err != nil {
+		if upstream != nil {
+			upstream.Close()
+		}
+		proxy.logger().Error("Error hijacking connection", "host", r.URL.Host, "err", err)
+		return
+	}
+	if _, err := io.WriteString(client, "HTTP/1.0 200 OK\r\n\r\n"); err != nil {
+		client.Close()
+		if upstream != nil {
+			upstream.Close()
+		}
+		return
+	}
+
+	if proxy.shouldMitm(client, clientBuf) {
+		proxy.serveMitm(client, clientBuf, r.URL.Host, proxyUser(r))
+		return
+	}
+	if upstream == nil {
+		if upstream, err = proxy.dialUpstream(r.URL.Host); err != nil {
+			proxy.logger().Warn("Error connecting", "host", r.URL.Host, "err", err)
+			client.Close()
+			return
+		}
+	}
+
+	conn := newWebSocketConn(proxy, nil)
+	conn.proxyUser = proxyUser(r)
+	conn.pipe(client, clientBuf, upstream)
+}
+
+const (
+	stateRequestHead = iota
+	stateResponseHead
+	stateFrames
+	statePassthrough
+)
+
+// A proxied connection which may carry a websocket
+type webSocketConn struct {
+	proxy        *HarProxy
+	start        time.Time
+	clientStream *webSocketStream
+	serverStream *webSocketStream
+
+	lock     sync.Mutex
+	req      *http.Request
+	resp     *http.Response
+	upgraded bool
+	messages []HarWebSocketMessage
+	// Messages beyond the proxy's WebSocketMaxMessages
+	droppedMessages int64
+
+	reqHeadersSize  int64
+	respHeadersSize int64
+
+	annotations map[string]interface{}
+	proxyUser   string
+	pageRef     string
+}
+
+func newWebSocketConn(proxy *HarProxy, req *http.Request) *webSocketConn {
+	conn := &webSocketConn{
+		proxy : proxy,
+		start : time.Now(),
+		req	  : req,
+		respHeadersSize : -1,
+		annotations		: proxy.currentAnnotations(),
+		pageRef			: proxy.currentPageRef(),
+	}
+	conn.clientStream = &webSocketStream{conn : conn, messageType : "send", state : stateRequestHead}
+	conn.serverStream = &webSocketStream{conn : conn, messageType : "receive", state : stateResponseHead}
+	if req != nil {
+		conn.clientStream.state = stateFrames
+	}
+	return conn
+}
+
+// Copies both directions until either side closes, then records the entry
+func (conn *webSocketConn) pipe(client net.Conn, clientBuf *bufio.ReadWriter, upstream net.Conn) {
+	done := make(chan bool)
+	go func() {
+		io.Copy(io.MultiWriter(conn.clientStream, upstream), clientBuf)
+		client.Close()
+		upstream.Close()
+		done <- true
+	}()
+	io.Copy(io.MultiWriter(conn.serverStream, client), upstream)
+	client.Close()
+	upstream.Close()
+	<-done
+
+	conn.lock.Lock()
+	entry := reqAndResp{
+		req				  : conn.req,
+		start			  : conn.start,
+		resp			  : conn.resp,
+		end				  : time.Now(),
+		webSocketMessages : conn.messages,
+		webSocketDroppedMessages : conn.droppedMessages,
+		reqHeadersSize	  : conn.reqHeadersSize,
+		respHeadersSize	  : conn.respHeadersSize,
+		annotations		  : conn.annotations,
+		proxyUser		  : conn.proxyUser,
+		pageRef			  : conn.pageRef,
+	}
+	if conn.resp == nil {
+		entry.respBodySize = -1
+	}
+	conn.lock.Unlock()
+	if entry.req != nil {
+		conn.proxy.entryChannel <- entry
+	}
+}
+
+// True once the server answered the handshake without switching protocols
+func (conn *webSocketConn) upgradeFailed() bool {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.resp != nil && !conn.upgraded
+}
+
+// Records message, or counts it as dropped once the connection has the proxy's WebSocketMaxMessages
+func (conn *webSocketConn) addMessage(message HarWebSocketMessage) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if max := conn.proxy.WebSocketMaxMessages; max > 0 && len(conn.messages) >= max {
+		conn.droppedMessages++
+		return
+	}
+	conn.messages = append(conn.messages, message)
+}
+
+// Watches the bytes going one way through a connection.
+// Writes never fail or block, so the connection is never held up by what we record.
+type webSocketStream struct {
+	conn        *webSocketConn
+	messageType string
+	state       int
+	head        []byte
+
+	// The frame currently being read
+	frameHeader []byte
+	payloadLeft uint64
+	payloadRead uint64
+	mask        []byte
+
+	// The message currently being assembled from frames
+	opcode  int
+	payload []byte
+}
+
+func (stream *webSocketStream) Write(p []byte) (int, error) {
+	stream.consume(p)
+	return len(p), nil
+}
+
+func (stream *webSocketStream) consume(p []byte) {
+	switch stream.state {
+	case stateRequestHead, stateResponseHead:
+		if rest, ok := stream.readHead(p); ok {
+			stream.consume(rest)
+		}
+	case stateFrames:
+		if stream.messageType == "send" && stream.conn.upgradeFailed() {
+			stream.state = statePassthrough
+			return
+		}
+		for len(p) > 0 {
+			p = stream.readFrame(p)
+		}
+	}
+}
+
+// Collects the request or response head, returning the bytes following it once it is complete
+func (stream *webSocketStream) readHead(p []byte) ([]byte, bool) {
+	if len(stream.head) == 0 && len(p) > 0 && (p[0] < 'A' || p[0] > 'Z') {
+		stream.state = statePassthrough
+		return nil, false
+	}
+	stream.head = append(stream.head, p...)
+	end := bytes.Index(stream.head, []byte("\r\n\r\n"))
+	if end < 0 {
+		if len(stream.head) > maxWebSocketHeadSize {
+			stream.state = statePassthrough
+			stream.head = nil
+		}
+		return nil, false
+	}
+	head, rest := stream.head[:end+4], stream.head[end+4:]
+	stream.head = nil
+	stream.state = statePassthrough
+
+	conn := stream.conn
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if stream.messageType == "send" {
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+		if err != nil || !isWebSocketRequest(req) {
+			return nil, false
+		}
+		req.URL.Scheme = "http"
+		req.URL.Host = req.Host
+		conn.req = req
+		conn.reqHeadersSize = int64(len(head))
+	} else {
+		if conn.req == nil {
+			return nil, false
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), conn.req)
+		if err != nil {
+			return nil, false
+		}
+		conn.resp = resp
+		conn.respHeadersSize = int64(len(head))
+		conn.upgraded = resp.StatusCode == http.StatusSwitchingProtocols
+		if !conn.upgraded {
+			return nil, false
+		}
+	}
+	stream.state = stateFrames
+	return rest, true
+}
+
+// Reads as much of the current frame as p holds, returning what is left of p
+func (stream *webSocketStream) readFrame(p []byte) []byte {
+	if stream.mask == nil {
+		for len(p) > 0 && !stream.frameHeaderComplete() {
+			stream.frameHeader = append(stream.frameHeader, p[0])
+			p = p[1:]
+		}
+		if !stream.frameHeaderComplete() {
+			return p
+		}
+		stream.startFrame()
+	}
+
+	n := uint64(len(p))
+	if n > stream.payloadLeft {
+		n = stream.payloadLeft
+	}
+	stream.capturePayload(p[:n])
+	stream.payloadLeft -= n
+	if stream.payloadLeft == 0 {
+		stream.endFrame()
+	}
+	return p[n:]
+}
+
+func (stream *webSocketStream) frameHeaderLength() int {
+	header := stream.frameHeader
+	if len(header) < 2 {
+		return 2
+	}
+	length := 2
+	switch header[1] & 0x7f {
+	case 126:
+		length += 2
+	case 127:
+		length += 8
+	}
+	if header[1] & 0x80 != 0 {
+		length += 4
+	}
+	return length
+}
+
+func (stream *webSocketStream) frameHeaderComplete() bool {
+	return len(stream.frameHeader) >= 2 && len(stream.frameHeader) == stream.frameHeaderLength()
+}
+
+func (stream *webSocketStream) startFrame() {
+	header := stream.frameHeader
+	offset := 2
+	switch header[1] & 0x7f {
+	case 126:
+		stream.payloadLeft = uint64(binary.BigEndian.Uint16(header[2:4]))
+		offset += 2
+	case 127:
+		stream.payloadLeft = binary.BigEndian.Uint64(header[2:10])
+		offset += 8
+	default:
+		stream.payloadLeft = uint64(header[1] & 0x7f)
+	}
+	stream.mask = []byte{}
+	if header[1] & 0x80 != 0 {
+		stream.mask = header[offset:offset+4]
+	}
+	stream.payloadRead = 0
+
+	if opcode := int(header[0] & 0x0f); opcode != 0 && opcode < 8 {
+		stream.opcode = opcode
+		stream.payload = nil
+	}
+}
+
+func (stream *webSocketStream) capturePayload(p []byte) {
+	proxy := stream.conn.proxy
+	if proxy.WebSocketMetadataOnly || stream.isControlFrame() {
+		stream.payloadRead += uint64(len(p))
+		return
+	}
+	for _, b := range p {
+		if len(stream.payload) >= proxy.WebSocketMaxMessageSize {
+			break
+		}
+		if len(stream.mask) > 0 {
+			b ^= stream.mask[stream.payloadRead % 4]
+		}
+		stream.payload = append(stream.payload, b)
+		stream.payloadRead++
+	}
+}
+
+func (stream *webSocketStream) isControlFrame() bool {
+	return stream.frameHeader[0] & 0x08 != 0
+}
+
+func (stream *webSocketStream) endFrame() {
+	fin := stream.frameHeader[0] & 0x80 != 0
+	control := stream.isControlFrame()
+	stream.frameHeader = nil
+	stream.mask = nil
+	if control || !fin || stream.opcode == 0 {
+		return
+	}
+
+	message := HarWebSocketMessage{
+		Type   : stream.messageType,
+		Time   : float64(time.Now().UnixNano()) / 1e9,
+		Opcode : stream.opcode,
+	}
+	if !stream.conn.proxy.WebSocketMetadataOnly {
+		if stream.opcode == 2 {
+			message.Data = base64.StdEncoding.EncodeToString(stream.payload)
+		} else {
+			message.Data = string(stream.payload)
+		}
+	}
+	stream.opcode = 0
+	stream.payload = nil
+	stream.conn.addMessage(message)
+}
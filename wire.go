@@ -0,0 +1,259 @@
+package goharproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bytes of messages as they were on the wire
+
+// Longest header block found among the bytes read from a connection, sizes of longer ones are computed from the parsed headers
+const maxRawHeaderBytes = 64 << 10
+
+// Bytes buffered readers may read past a header block before it is looked for
+const rawReadAhead = 8 << 10
+
+// A connection keeping the last bytes read from it, among which the header blocks of its messages are found
+type wireConn struct {
+	net.Conn
+	lock      sync.Mutex
+	read      []byte
+	recording bool
+}
+
+func newWireConn(conn net.Conn) *wireConn {
+	return &wireConn{Conn: conn, recording: true}
+}
+
+func (conn *wireConn) Read(p []byte) (int, error) {
+	n, err := conn.Conn.Read(p)
+	if n > 0 {
+		conn.lock.Lock()
+		if conn.recording {
+			conn.read = append(conn.read, p[:n]...)
+			// Trimmed once twice too long, so bodies aren't copied on every read
+			if keep := maxRawHeaderBytes + rawReadAhead; len(conn.read) > 2 * keep {
+				conn.read = append(conn.read[:0], conn.read[len(conn.read) - keep:]...)
+			}
+		}
+		conn.lock.Unlock()
+	}
+	return n, err
+}
+
+// Stops keeping bytes, once the connection no longer carries HTTP messages
+func (conn *wireConn) stopRecording() {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.recording = false
+	conn.read = nil
+}
+
+// Finds the header block whose first line starts with startLine followed by one of next and whose headers are
+// header, and forgets the bytes up to its end. Returns nil when it is not among the bytes kept.
+// A message starts right after the body before it, so text of that body may look like a start line, hence the check of header.
+func (conn *wireConn) takeHeaderBlock(startLine string, next string, header http.Header, removed ...string) []byte {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for offset := 0; offset < len(conn.read); {
+		i := bytes.Index(conn.read[offset:], []byte(startLine))
+		if i < 0 {
+			return nil
+		}
+		start := offset + i
+		after := start + len(startLine)
+		offset = start + 1
+		if after >= len(conn.read) || bytes.IndexByte([]byte(next), conn.read[after]) < 0 {
+			continue
+		}
+		length := headerBlockLength(conn.read[start:])
+		if length < 0 || length > maxRawHeaderBytes || !blockHasHeaders(conn.read[start:start + length], header, removed) {
+			continue
+		}
+		block := append([]byte(nil), conn.read[start:start + length]...)
+		conn.read = append(conn.read[:0], conn.read[start + length:]...)
+		return block
+	}
+	return nil
+}
+
+// Whether the header lines of block are the values of header, but for those named in removed, which net/http or we took out of it
+func blockHasHeaders(block []byte, header http.Header, removed []string) bool {
+	values := 0
+	for _, headerValues := range header {
+		values += len(headerValues)
+	}
+	lines := 0
+	for _, pair := range headerBlockPairs(block) {
+		name := http.CanonicalHeaderKey(pair.Name)
+		if containsString(removed, name) {
+			continue
+		}
+		if !containsString(header[name], pair.Value) {
+			return false
+		}
+		lines++
+	}
+	return lines == values
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Length of the start line and headers up to and including the empty line ending them, -1 when incomplete.
+// Lines may end with a bare LF, as net/http accepts them.
+func headerBlockLength(b []byte) int {
+	for pos, first := 0, true; ; first = false {
+		i := bytes.IndexByte(b[pos:], '\n')
+		if i < 0 {
+			return -1
+		}
+		line := b[pos:pos + i]
+		pos += i + 1
+		if !first && len(bytes.TrimSuffix(line, []byte("\r"))) == 0 {
+			return pos
+		}
+	}
+}
+
+// One pair per header line of a header block, in wire order and with the casing it was sent with.
+// Folded lines are joined to the header they continue with a space, as net/http does.
+func headerBlockPairs(block []byte) []HarNameValuePair {
+	lines := strings.Split(string(block), "\n")
+	pairs := make([]HarNameValuePair, 0, len(lines))
+	for _, line := range lines[1:] {
+		line = strings.TrimSuffix(line, "\r")
+		if line != "" && (line[0] == ' ' || line[0] == '\t') && len(pairs) > 0 {
+			last := &pairs[len(pairs) - 1]
+			last.Value = strings.TrimSpace(last.Value + " " + strings.TrimSpace(line))
+			continue
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon <= 0 {
+			continue
+		}
+		pairs = append(pairs, HarNameValuePair{Name: line[:colon], Value: strings.TrimSpace(line[colon + 1:])})
+	}
+	return pairs
+}
+
+// The headers of a request's header block, without the credentials it sent the proxy
+func requestHeaderPairs(block []byte) []HarNameValuePair {
+	pairs := headerBlockPairs(block)
+	headers := pairs[:0]
+	for _, pair := range pairs {
+		if !strings.EqualFold(pair.Name, "Proxy-Authorization") {
+			headers = append(headers, pair)
+		}
+	}
+	return headers
+}
+
+// Hands out the accepted connections as wireConns
+type wireListener struct {
+	net.Listener
+}
+
+func (l wireListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newWireConn(conn), nil
+}
+
+type wireConnKey struct{}
+
+// Lets the requests served on a wireConn find it, for http.Server.ConnContext
+func withWireConn(ctx context.Context, conn net.Conn) context.Context {
+	if wire, ok := conn.(*wireConn); ok {
+		return context.WithValue(ctx, wireConnKey{}, wire)
+	}
+	return ctx
+}
+
+// The request line and headers of req as read from the client, nil when unknown
+func requestHeaderBlock(req *http.Request) []byte {
+	conn, ok := req.Context().Value(wireConnKey{}).(*wireConn)
+	if !ok || req.ProtoMajor != 1 || req.RequestURI == "" {
+		return nil
+	}
+	return conn.takeHeaderBlock(req.Method + " " + req.RequestURI + " " + req.Proto, "\r\n", req.Header,
+		"Host", "Transfer-Encoding", "Proxy-Authorization")
+}
+
+// The status line and headers of resp as read from conn, nil when unknown
+func responseHeaderBlock(conn net.Conn, resp *http.Response) []byte {
+	wire, ok := conn.(*wireConn)
+	if !ok || resp.ProtoMajor != 1 {
+		return nil
+	}
+	return wire.takeHeaderBlock(resp.Proto + " " + strconv.Itoa(resp.StatusCode), " \r\n", resp.Header, "Transfer-Encoding")
+}
+
+// Transport sending requests upstream over HTTP/1.1 on wireConns, with TLS under them so what they keep is plain text
+func newWireTransport() *http.Transport {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		DisableCompression	: true,
+		IdleConnTimeout		: 90 * time.Second,
+	}
+	transport.DialContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newWireConn(conn), nil
+	}
+	transport.DialTLSContext = func(ctx context.Context, network string, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		config := transport.TLSClientConfig.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			config.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		config.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return newWireConn(tlsConn), nil
+	}
+	return transport
+}
+
+// Sends the request over HTTP/1.1, keeping its response's header block
+func (proxy *HarProxy) roundTripHttp1(req *http.Request, reqAndResp *reqAndResp) (*http.Response, error) {
+	var conn net.Conn
+	trace := &httptrace.ClientTrace{
+		GotConn : func(info httptrace.GotConnInfo) {
+			conn = info.Conn
+		},
+	}
+	req.RequestURI = ""
+	resp, err := proxy.wireTransport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err == nil && conn != nil {
+		reqAndResp.respHeaderBlock = responseHeaderBlock(conn, resp)
+	}
+	return resp, err
+}